@@ -0,0 +1,74 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"regexp"
+	"strings"
+)
+
+// serverSoftwares recognizes the common FTP servers in their welcome
+// message, along with their version when the first group matches it.
+var serverSoftwares = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"ProFTPD", regexp.MustCompile(`(?i)\bProFTPD(?:\s+(\d[\w.]*))?`)},
+	{"vsFTPd", regexp.MustCompile(`(?i)\bvsFTPd(?:\s+(\d[\w.]*))?`)},
+	{"Pure-FTPd", regexp.MustCompile(`(?i)\bPure-FTPd\b`)},
+	{"FileZilla Server", regexp.MustCompile(`(?i)\bFileZilla Server(?:\s+(?:version\s+)?(\d[\w.]*))?`)},
+	{"Microsoft FTP Service", regexp.MustCompile(`(?i)\bMicrosoft FTP Service\b`)},
+	{"Serv-U", regexp.MustCompile(`(?i)\bServ-U(?: FTP Server)?(?:\s+v?(\d[\w.]*))?`)},
+	{"wu-ftpd", regexp.MustCompile(`(?i)\bwu-(\d[\w.]*)`)},
+	{"glFTPd", regexp.MustCompile(`(?i)\bglFTPd(?:\s+(\d[\w.]*))?`)},
+	{"bftpd", regexp.MustCompile(`(?i)\bbftpd(?:\s+(\d[\w.]*))?`)},
+}
+
+// Banner returns the welcome message sent by the server when the connection
+// was opened, without the reply code. The lines of a multi-line message are
+// separated by "\n".
+func (c *Client) Banner() string {
+	return c.banner
+}
+
+// ServerSoftware returns the name of the server software, such as "ProFTPD",
+// as announced by the welcome message. It is a best effort guess, empty when
+// the software is not recognized.
+func (c *Client) ServerSoftware() string {
+	name, _ := parseServerSoftware(c.banner)
+	return name
+}
+
+// ServerVersion returns the version of the server software recognized by
+// ServerSoftware, empty when the welcome message does not tell it.
+func (c *Client) ServerVersion() string {
+	_, version := parseServerSoftware(c.banner)
+	return version
+}
+
+// parseServerSoftware recognizes the server software in a welcome message.
+func parseServerSoftware(banner string) (name, version string) {
+	for _, software := range serverSoftwares {
+		match := software.pattern.FindStringSubmatch(banner)
+		if match == nil {
+			continue
+		}
+		if len(match) > 1 {
+			version = strings.TrimRight(match[1], ".")
+		}
+		return software.name, version
+	}
+	return "", ""
+}
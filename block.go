@@ -0,0 +1,180 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// TransferMode is the way the data is sent over the data connections, as
+// set by the MODE FTP command.
+type TransferMode string
+
+// The transfer modes
+const (
+	// ModeStream sends the data as is, the default.
+	ModeStream TransferMode = "S"
+	// ModeBlock sends the data in blocks interleaved with restart markers,
+	// as described in RFC 959.
+	ModeBlock TransferMode = "B"
+	// ModeDeflate compresses the data, see SetCompression.
+	ModeDeflate TransferMode = "Z"
+)
+
+// The descriptor bits of the header of a block
+const (
+	blockEOF     = 64
+	blockRestart = 16
+)
+
+// restartMarkerInterval is the number of bytes sent in block mode between
+// two restart markers.
+const restartMarkerInterval = 1 << 20
+
+// SetTransferMode issues a MODE FTP command to change the way the data is
+// sent over the data connections. ErrUnsupported is returned when the server
+// does not implement the mode.
+func (c *Client) SetTransferMode(mode TransferMode) error {
+	switch mode {
+	case ModeStream, ModeBlock, ModeDeflate:
+	default:
+		return fmt.Errorf("Invalid transfer mode: %s", mode)
+	}
+	if mode == c.transferMode || mode == ModeStream && c.transferMode == "" {
+		return nil
+	}
+	if _, _, err := c.cmd(StatusCommandOK, "MODE %s", mode); err != nil {
+		return unsupported(err)
+	}
+	c.transferMode = mode
+	return nil
+}
+
+// RestartMarker returns the last restart marker of the latest transfer in
+// block mode: the last one received when downloading, or the last one
+// acknowledged by the server when uploading. The markers sent by this client
+// are byte offsets, which can be passed to RetrFrom or StorFrom to resume an
+// interrupted transfer.
+func (c *Client) RestartMarker() string {
+	return c.restartMarker
+}
+
+// blockConn is a data connection in block mode.
+type blockConn struct {
+	net.Conn
+	c *Client
+
+	// remaining is the number of bytes left in the block being read, and
+	// eof is set after the last block.
+	remaining int
+	last      bool
+	eof       bool
+
+	// sent is the offset of the next byte written, and marked the offset
+	// of the last restart marker.
+	sent   uint64
+	marked uint64
+}
+
+// Read returns the data of the blocks received, recording the restart
+// markers.
+func (b *blockConn) Read(buf []byte) (int, error) {
+	for b.remaining == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+		var header [3]byte
+		if _, err := io.ReadFull(b.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		count := int(header[1])<<8 | int(header[2])
+		if header[0]&blockRestart != 0 {
+			marker := make([]byte, count)
+			if _, err := io.ReadFull(b.Conn, marker); err != nil {
+				return 0, err
+			}
+			b.c.restartMarker = string(marker)
+			continue
+		}
+		b.remaining = count
+		b.last = header[0]&blockEOF != 0
+		b.eof = b.last && count == 0
+	}
+
+	if len(buf) > b.remaining {
+		buf = buf[:b.remaining]
+	}
+	n, err := b.Conn.Read(buf)
+	b.remaining -= n
+	if b.remaining == 0 && b.last {
+		b.eof = true
+	}
+	if err == io.EOF {
+		if b.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+// Write sends the data in blocks, with a restart marker every
+// restartMarkerInterval bytes.
+func (b *blockConn) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		size := len(buf)
+		if size > 0xffff {
+			size = 0xffff
+		}
+		if left := b.marked + restartMarkerInterval - b.sent; uint64(size) > left {
+			size = int(left)
+		}
+		if err := b.writeBlock(0, buf[:size]); err != nil {
+			return written, err
+		}
+		written += size
+		buf = buf[size:]
+		b.sent += uint64(size)
+
+		if b.sent-b.marked == restartMarkerInterval {
+			marker := strconv.FormatUint(b.sent, 10)
+			if err := b.writeBlock(blockRestart, []byte(marker)); err != nil {
+				return written, err
+			}
+			b.marked = b.sent
+		}
+	}
+	return written, nil
+}
+
+// endOfFile sends the empty block marking the end of the file.
+func (b *blockConn) endOfFile() error {
+	return b.writeBlock(blockEOF, nil)
+}
+
+func (b *blockConn) writeBlock(descriptor byte, data []byte) error {
+	block := make([]byte, 3+len(data))
+	block[0] = descriptor
+	block[1] = byte(len(data) >> 8)
+	block[2] = byte(len(data))
+	copy(block[3:], data)
+	_, err := b.Conn.Write(block)
+	return err
+}
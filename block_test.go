@@ -0,0 +1,97 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBlockMode(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetTransferMode(ModeBlock); err != nil {
+		t.Fatal(err)
+	}
+
+	// large enough for several blocks and two restart markers
+	data := bytes.Repeat([]byte(testData), 2*restartMarkerInterval/len(testData)+1000)
+	if err = c.Stor("big", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := mock.File("big"); !bytes.Equal(remote, data) {
+		t.Error("remote file differs from the uploaded one")
+	}
+	if marker := c.RestartMarker(); marker != "2097152" {
+		t.Errorf("restart marker %q, expected 2097152", marker)
+	}
+
+	if err = c.Stor("empty", bytes.NewReader(nil)); err != nil {
+		t.Error(err)
+	}
+
+	mock.SetFile("file", []byte(testData))
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if string(buf) != testData {
+		t.Errorf("read %q, expected %q", buf, testData)
+	}
+	if marker := c.RestartMarker(); marker != "7" {
+		t.Errorf("restart marker %q, expected 7", marker)
+	}
+
+	if err = c.SetTransferMode(ModeStream); err != nil {
+		t.Error(err)
+	}
+	if err = c.SetTransferMode("X"); err == nil {
+		t.Error("expected error for an invalid mode, got nil")
+	}
+}
+
+func TestBlockModeUnsupported(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("MODE", func(s *mockSession, arg string) {
+		s.Reply(StatusNotImplementedParameter, "Only stream mode is supported")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetTransferMode(ModeBlock); err != ErrUnsupported {
+		t.Errorf("got error %v, expected ErrUnsupported", err)
+	}
+}
@@ -15,15 +15,75 @@
 package ftp
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"time"
+)
+
+var (
+	// ErrUnsupported is returned when the remote FTP server does not
+	// implement the requested command.
+	ErrUnsupported = errors.New("Command not supported by the server")
+
+	// ErrDataTLSHandshake is returned when the TLS handshake of a data
+	// connection fails, most often because the server requires the TLS
+	// session of the control connection to be resumed.
+	ErrDataTLSHandshake = errors.New("TLS handshake of the data connection failed")
+
+	// ErrCommandTimeout is returned when the server did not reply to a
+	// command within the delay set with SetCommandTimeout.
+	ErrCommandTimeout = errors.New("Command timed out")
+
+	// ErrCertFingerprint is returned when the certificate of the server
+	// does not match the fingerprint set with WithCertFingerprint.
+	ErrCertFingerprint = errors.New("Server certificate fingerprint mismatch")
+
+	// ErrRestartIgnored is returned when the reply to a REST command does
+	// not acknowledge the restart offset, see SetRestartVerification.
+	ErrRestartIgnored = errors.New("Restart offset not acknowledged by the server")
+
+	// ErrTransferTypeMismatch is returned when a download does not have the
+	// size reported by the server, typically a file sent in ASCII despite
+	// TYPE I, see SetSizeVerification.
+	ErrTransferTypeMismatch = errors.New("Downloaded size differs from the size reported by the server")
+
+	// ErrPathTooLong is returned, wrapped with the details, when a path
+	// exceeds the limit set with SetMaxPathLength, or when the server
+	// rejects a path as too long.
+	ErrPathTooLong = errors.New("Path too long")
+
+	// ErrDataHostMismatch is returned when a PASV reply advertises another
+	// address than the one of the server, see SetStrictDataHost. It is
+	// reported to the event handler when another host connects to the port
+	// announced in active mode.
+	ErrDataHostMismatch = errors.New("Data connection address differs from the server address")
+
+	// ErrUploadNotVisible is returned, wrapped with the details, when an
+	// uploaded file does not get the size of the data sent, see
+	// SetPostStorVerify.
+	ErrUploadNotVisible = errors.New("Uploaded file not visible with its full size")
+
+	// ErrChecksumMismatch is returned, wrapped with the details, when the
+	// hash of a download differs from the one computed by the server, see
+	// DownloadVerified.
+	ErrChecksumMismatch = errors.New("Downloaded data differs from the hash computed by the server")
+
+	// ErrResponseNotClosed is reported to the event handler when the reader
+	// of a data connection is garbage collected without being closed,
+	// leaving the control connection out of sync.
+	ErrResponseNotClosed = errors.New("Data connection never closed")
 )
 
 // feat issues a FEAT FTP command to list the additional commands supported by
 // the remote FTP server.
 // FEAT is described in RFC 2389
-func (c *client) feat() error {
+func (c *Client) feat() error {
 	code, message, err := c.cmd(-1, "FEAT")
 	if err != nil {
 		return err
@@ -52,43 +112,412 @@ func (c *client) feat() error {
 	return nil
 }
 
+// SetCommandTimeout sets the maximum delay to wait for the reply to a command
+// on the control connection, 0 meaning no limit. The transfers themselves
+// are not limited.
+//
+// ErrCommandTimeout is returned when the delay expires. As the reply may
+// still come later, the connection is then marked as suspect.
+func (c *Client) SetCommandTimeout(d time.Duration) {
+	c.commandTimeout = d
+}
+
+// Suspect reports whether a command timed out on the connection, in which
+// case the replies may be out of sync and the connection should be closed.
+func (c *Client) Suspect() bool {
+	return c.suspect
+}
+
+// SetUnsolicitedHandler sets the handler receiving the unsolicited messages
+// of the server, such as shutdown notices. While waiting for the reply to a
+// command, the replies which can not answer it are passed to the handler
+// instead, and the client keeps reading: a 421, and a 1xx to a command other
+// than a transfer. When the server closes the connection after a 421, the 421
+// is taken for the reply.
+//
+// The other messages sent while no command is pending can not be told apart
+// from the reply to the next command.
+func (c *Client) SetUnsolicitedHandler(handler func(code int, msg string)) {
+	c.unsolicitedHandler = handler
+}
+
+// transferCommands are the commands whose replies start with a 1xx before
+// the transfer.
+var transferCommands = map[string]bool{
+	"APPE": true,
+	"LIST": true,
+	"MLSD": true,
+	"NLST": true,
+	"RETR": true,
+	"STOR": true,
+	"STOU": true,
+}
+
+// unsolicitedReply reports whether a reply with code can not answer the
+// command of format, and must be passed to the unsolicited handler.
+func unsolicitedReply(format string, code int) bool {
+	return code == StatusNotAvailable || code/100 == 1 && !transferCommands[commandName(format)]
+}
+
+// readReply reads the reply to the command of format, passing the
+// unsolicited messages to the unsolicited handler.
+func (c *Client) readReply(format string) (int, string, error) {
+	var notice *textproto.Error
+	for {
+		code, msg, err := c.conn.ReadResponse(-1)
+		if err != nil && notice != nil {
+			// the server closed the connection after its notice
+			return notice.Code, notice.Msg, nil
+		}
+		if err != nil || c.unsolicitedHandler == nil || !unsolicitedReply(format, code) {
+			return code, msg, err
+		}
+		c.unsolicitedHandler(code, msg)
+		if code == StatusNotAvailable {
+			notice = &textproto.Error{Code: code, Msg: msg}
+		}
+	}
+}
+
+// commandName returns the name of the command of format, such as "RETR" or
+// "SITE CHMOD": the words before the first argument, without the options
+// such as the -a of "LIST -a", in upper case.
+func commandName(format string) string {
+	if i := strings.IndexByte(format, '%'); i >= 0 {
+		format = format[:i]
+	}
+	var words []string
+	for _, word := range strings.Fields(format) {
+		if !strings.HasPrefix(word, "-") {
+			words = append(words, word)
+		}
+	}
+	return strings.ToUpper(strings.Join(words, " "))
+}
+
 // cmd is a helper function to execute a command and check for the expected FTP
 // return code
-func (c *client) cmd(expected int, format string, args ...interface{}) (int, string, error) {
+func (c *Client) cmd(expected int, format string, args ...interface{}) (int, string, error) {
+	if err := c.checkPathLength(format, args); err != nil {
+		return 0, "", err
+	}
+	start := time.Now()
 	_, err := c.conn.Cmd(format, args...)
 	if err != nil {
 		return 0, "", err
 	}
-	return c.conn.ReadResponse(expected)
+	c.stats.sent()
+	if c.commandTimeout > 0 {
+		c.netConn.SetReadDeadline(time.Now().Add(c.commandTimeout))
+		defer c.netConn.SetReadDeadline(time.Time{})
+	}
+	code, msg, err := c.readReply(format)
+	c.stats.replied(time.Since(start))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			c.suspect = true
+			return 0, "", ErrCommandTimeout
+		}
+		return code, msg, err
+	}
+	if !expectedCode(code, expected) && !c.acceptedCode(format, code) {
+		return code, msg, pathTooLong(&textproto.Error{Code: code, Msg: msg})
+	}
+	return code, msg, nil
+}
+
+// SetAcceptedCodes makes the client accept the given reply codes as success
+// for the FTP command named command, such as "MKD" or "SITE CHMOD", in
+// addition to the codes it expects. For the transfer commands, such as RETR,
+// the codes are accepted as the start of the transfer. It is an escape hatch
+// for the servers whose replies deviate from the standards in ways the client
+// does not handle. Calling it without any code removes the codes previously
+// accepted for the command.
+func (c *Client) SetAcceptedCodes(command string, codes ...int) {
+	command = commandName(command)
+	if len(codes) == 0 {
+		delete(c.acceptedCodes, command)
+		return
+	}
+	if c.acceptedCodes == nil {
+		c.acceptedCodes = make(map[string][]int)
+	}
+	c.acceptedCodes[command] = codes
+}
+
+// acceptedCode reports whether code was accepted with SetAcceptedCodes for
+// the command of format.
+func (c *Client) acceptedCode(format string, code int) bool {
+	for _, accepted := range c.acceptedCodes[commandName(format)] {
+		if code == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaxPathLength sets the maximum length in bytes of the paths sent to the
+// server, 0 meaning no limit. The commands whose path is longer fail with
+// ErrPathTooLong before being sent, rather than with the unclear replies
+// some servers make.
+func (c *Client) SetMaxPathLength(n int) {
+	c.maxPathLength = n
+}
+
+// MaxPathLength returns the limit set with SetMaxPathLength.
+func (c *Client) MaxPathLength() int {
+	return c.maxPathLength
+}
+
+// pathArgs lists, for the commands taking paths, the indexes of their
+// arguments which are paths.
+var pathArgs = map[string][]int{
+	"APPE":         {0},
+	"AVBL":         {0},
+	"CWD":          {0},
+	"DELE":         {0},
+	"HASH":         {0},
+	"LIST":         {0},
+	"MDTM":         {0},
+	"MFMT":         {1},
+	"MKD":          {0},
+	"MLSD":         {0},
+	"MLST":         {0},
+	"NLST":         {0},
+	"RETR":         {0},
+	"RMD":          {0},
+	"RNFR":         {0},
+	"RNTO":         {0},
+	"SIZE":         {0},
+	"STOR":         {0},
+	"SITE CHMOD":   {1},
+	"SITE SYMLINK": {0, 1},
+	"SITE UTIME":   {0},
+}
+
+// checkPathLength checks the length of the path arguments of a command
+// against the limit set with SetMaxPathLength. The arguments of the other
+// commands, such as the password of PASS, are not checked.
+func (c *Client) checkPathLength(format string, args []interface{}) error {
+	if c.maxPathLength <= 0 {
+		return nil
+	}
+	for _, i := range pathArgs[commandName(format)] {
+		if i >= len(args) {
+			continue
+		}
+		if s, ok := args[i].(string); ok && len(s) > c.maxPathLength {
+			return fmt.Errorf("%w: %d bytes, the limit is %d", ErrPathTooLong, len(s), c.maxPathLength)
+		}
+	}
+	return nil
+}
+
+// pathTooLongError is the reply of a server rejecting a path as too long.
+// It matches ErrPathTooLong with errors.Is, and unwraps to the reply so that
+// its code remains available to errors.As.
+type pathTooLongError struct {
+	reply *textproto.Error
+}
+
+func (e *pathTooLongError) Error() string {
+	return ErrPathTooLong.Error() + ": " + e.reply.Msg
+}
+
+func (e *pathTooLongError) Is(target error) bool {
+	return target == ErrPathTooLong
+}
+
+func (e *pathTooLongError) Unwrap() error {
+	return e.reply
+}
+
+// pathTooLong returns a *pathTooLongError when err is a reply rejecting a
+// path as too long, such as "550 File name too long". Otherwise err is
+// returned unchanged.
+func pathTooLong(err error) error {
+	if protoErr, ok := err.(*textproto.Error); ok && strings.Contains(strings.ToLower(protoErr.Msg), "too long") {
+		return &pathTooLongError{protoErr}
+	}
+	return err
+}
+
+// equivalentCodes lists, for the reply codes the commands expect, the other
+// codes some servers send to mean the same success.
+var equivalentCodes = map[int][]int{
+	// CDUP and TYPE are sometimes answered like CWD
+	StatusCommandOK: {StatusRequestedFileActionOK},
+	// CWD, DELE, RMD and RNTO are sometimes answered with a plain 200
+	StatusRequestedFileActionOK: {StatusCommandOK},
+	// RFC 959 allows 250 once a transfer is complete
+	StatusClosingDataConnection: {StatusRequestedFileActionOK},
+	// MKD is sometimes answered like CWD
+	StatusPathCreated: {StatusRequestedFileActionOK},
+	// RFC 959 allows 202 when PASS is superfluous
+	StatusLoggedIn: {StatusCommandNotImplemented},
+}
+
+// expectedCode reports whether a reply code is the expected one, or one of
+// its equivalents. A negative expected code accepts any reply.
+func expectedCode(code, expected int) bool {
+	if expected < 0 || code == expected {
+		return true
+	}
+	for _, equivalent := range equivalentCodes[expected] {
+		if code == equivalent {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupported turns the replies of a server which does not implement a
+// command into ErrUnsupported.
+func unsupported(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		switch protoErr.Code {
+		case StatusBadCommand, StatusNotImplemented, StatusNotImplementedParameter:
+			return ErrUnsupported
+		}
+	}
+	return err
 }
 
 // cmdDataConnFrom executes a command which require a FTP data connection.
 // Issues a REST FTP command to specify the number of bytes to skip for the transfer.
-func (c *client) cmdDataConnFrom(offset uint64, format string, args ...interface{}) (net.Conn, error) {
-	conn, err := c.openDataConn()
+func (c *Client) cmdDataConnFrom(offset uint64, format string, args ...interface{}) (net.Conn, error) {
+	if err := c.checkPathLength(format, args); err != nil {
+		return nil, err
+	}
+	// in active mode, the server connects once the command is accepted
+	var pending io.Closer
+	var err error
+	if c.activeMode {
+		pending, err = c.openActiveDataConn()
+	} else {
+		pending, err = c.openDataConn()
+	}
 	if err != nil {
 		return nil, err
 	}
 	if offset != 0 {
-		_, _, err := c.cmd(StatusRequestFilePending, "REST %d", offset)
+		_, msg, err := c.cmd(StatusRequestFilePending, "REST %d", offset)
 		if err != nil {
-			conn.Close()
+			pending.Close()
 			return nil, err
 		}
+		if c.verifyRestart && !containsNumber(msg, offset) {
+			pending.Close()
+			return nil, ErrRestartIgnored
+		}
 	}
-	_, err = c.conn.Cmd(format, args...)
+	code, msg, err := c.cmd(-1, format, args...)
 	if err != nil {
-		conn.Close()
+		pending.Close()
 		return nil, err
 	}
-	code, msg, err := c.conn.ReadResponse(-1)
-	if err != nil {
-		conn.Close()
-		return nil, err
+	switch code {
+	case StatusAlreadyOpen, StatusAboutToSend:
+	case StatusClosingDataConnection:
+		// Some servers send the final reply at once, before the data which
+		// is still to be read from the data connection.
+		c.transferDone = true
+	default:
+		if !c.acceptedCode(format, code) {
+			pending.Close()
+			return nil, pathTooLong(&textproto.Error{Code: code, Msg: msg})
+		}
 	}
-	if code != StatusAlreadyOpen && code != StatusAboutToSend {
-		conn.Close()
-		return nil, &textproto.Error{Code: code, Msg: msg}
+	conn, ok := pending.(net.Conn)
+	if !ok {
+		if conn, err = c.acceptDataConn(pending.(net.Listener)); err != nil {
+			// the server reports the failed transfer
+			if !c.transferDone {
+				c.conn.ReadResponse(-1)
+			}
+			c.transferDone = false
+			return nil, err
+		}
+	}
+	// Complete the handshake now: a transfer may not exchange any byte.
+	if tconn, ok := conn.(*tls.Conn); ok {
+		if err = tconn.Handshake(); err != nil {
+			conn.Close()
+			// the server reports the failed transfer
+			if !c.transferDone {
+				c.conn.ReadResponse(-1)
+			}
+			c.transferDone = false
+			return nil, fmt.Errorf("%w: %v", ErrDataTLSHandshake, err)
+		}
+	}
+	c.transferMu.Lock()
+	c.transferring = true
+	c.transferMu.Unlock()
+
+	switch c.transferMode {
+	case ModeDeflate:
+		return &deflateConn{Conn: conn}, nil
+	case ModeBlock:
+		c.restartMarker = ""
+		return &blockConn{Conn: conn, c: c, sent: offset, marked: offset}, nil
 	}
 	return conn, nil
 }
+
+// SetRestartVerification makes the transfers resumed at an offset, such as
+// RetrFrom, fail with ErrRestartIgnored unless the reply of the server to the
+// REST command repeats the offset, like "350 Restarting at 1024", so that a
+// server ignoring the offset does not silently corrupt the resumed file. Most
+// servers repeat it, but check yours before enabling this.
+func (c *Client) SetRestartVerification(enable bool) {
+	c.verifyRestart = enable
+}
+
+// SetSizeVerification makes the downloads issue a SIZE FTP command first,
+// and fail with ErrTransferTypeMismatch when closed if the size of the data
+// received differs: some servers accept TYPE I but send the files in ASCII,
+// corrupting the binary files by translating their line endings. The files
+// whose size the server does not report are not verified.
+func (c *Client) SetSizeVerification(enable bool) {
+	c.verifySize = enable
+}
+
+// postStorTimeout is the delay after which SetPostStorVerify gives up, and
+// postStorInterval the first delay between two SIZE FTP commands, doubled
+// each time.
+var (
+	postStorTimeout  = 5 * time.Second
+	postStorInterval = 50 * time.Millisecond
+)
+
+// SetPostStorVerify makes the uploads with STOR poll the size of the file
+// with SIZE FTP commands after the final reply, until it matches the data
+// sent, failing with ErrUploadNotVisible after a few seconds. Some servers
+// acknowledge an upload before committing it, and report an empty or missing
+// file for a moment: typically the gateways to an object storage, and the
+// servers writing to a network filesystem. Nothing is verified when the
+// server does not implement SIZE.
+func (c *Client) SetPostStorVerify(enable bool) {
+	c.postStorVerify = enable
+}
+
+// containsNumber reports whether n is one of the numbers in msg.
+func containsNumber(msg string, n uint64) bool {
+	numbers := strings.FieldsFunc(msg, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	for _, number := range numbers {
+		if number == strconv.FormatUint(n, 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// endOfFileWriter is implemented by the data connections which must mark the
+// end of an upload, other than by closing the connection.
+type endOfFileWriter interface {
+	endOfFile() error
+}
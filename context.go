@@ -0,0 +1,181 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// DialContext is like DialTimeout, but connecting to the server and reading
+// its welcome message and features are bounded by ctx instead of a timeout.
+//
+// The deadline of ctx is a budget shared by all the calls given the same
+// ctx: connecting consumes part of it, and the following LoginContext and
+// operations such as ListContext only get what remains.
+func DialContext(ctx context.Context, addr string, opts ...Option) (*Client, error) {
+	return dialContext(ctx, addr, 0, opts)
+}
+
+// LoginContext is like Login, but gives up once ctx is done, returning
+// ctx.Err(). The connection should then be closed, as the server may still
+// reply to the commands sent.
+func (c *Client) LoginContext(ctx context.Context, user, password string) error {
+	return c.withContext(ctx, func() error {
+		return c.Login(user, password)
+	})
+}
+
+// withContext calls fn, which exchanges commands and replies on the control
+// connection, making its reads fail once ctx is done. The error of ctx is
+// returned instead of the one of fn when ctx interrupted it.
+func (c *Client) withContext(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn := c.netConn
+	stop := watchContext(ctx, conn)
+	err := fn()
+	stop()
+	conn.SetDeadline(time.Time{})
+	if err == nil {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ctx.Err() != nil || ok && !time.Now().Before(deadline) {
+		// the reply to the interrupted command may still come
+		c.suspect = true
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return err
+}
+
+// RetrContext is like Retr, but gives up once ctx is done, whose deadline
+// also bounds the data connection: the transfer is then aborted with an ABOR
+// FTP command, and ctx.Err() is returned by Read and Close.
+func (c *Client) RetrContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := c.withContext(ctx, func() (err error) {
+		r, err = c.Retr(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := r.(*response)
+	return &contextResponse{response: resp, ctx: ctx, stop: watchContext(ctx, resp.conn)}, nil
+}
+
+// contextResponse is the reader returned by RetrContext.
+type contextResponse struct {
+	*response
+	ctx  context.Context
+	stop func()
+}
+
+// Read implements the io.Reader interface, returning ctx.Err() once ctx is
+// done.
+func (cr *contextResponse) Read(buf []byte) (int, error) {
+	n, err := cr.response.Read(buf)
+	if err != nil && err != io.EOF {
+		if ctxErr := contextErr(cr.ctx, err); ctxErr != nil {
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface, aborting the transfer once ctx
+// is done.
+func (cr *contextResponse) Close() error {
+	if cr.closed {
+		return nil
+	}
+	cr.stop()
+	if err := cr.ctx.Err(); err != nil {
+		if cr.abort() != nil {
+			cr.c.suspect = true
+		}
+		return err
+	}
+	return cr.response.Close()
+}
+
+// StorContext is like Stor, but gives up once ctx is done, whose deadline
+// bounds the commands and replies on the control connection as well as the
+// data connection, returning ctx.Err(). The server may keep the part of the
+// file received until then.
+func (c *Client) StorContext(ctx context.Context, path string, r io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := c.storCmd(ctx, "STOR", path, r, 0)
+	return err
+}
+
+// ListContext is like List, but gives up once ctx is done: the listing is
+// then aborted with an ABOR FTP command and ctx.Err() is returned, leaving
+// the connection usable for the next commands.
+func (c *Client) ListContext(ctx context.Context, path string) (entries []*Entry, err error) {
+	err = c.listCallback(ctx, path, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// watchContext limits the reads and writes on conn by the deadline of ctx,
+// and makes them fail as soon as ctx is canceled. The returned function
+// stops watching ctx.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// contextErr returns the error of ctx when it interrupted a read on a
+// connection watched by watchContext, which failed with err.
+func contextErr(ctx context.Context, err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && ctx.Done() != nil {
+		// the deadline of the connection may expire just before ctx
+		<-ctx.Done()
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,316 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestListContextCanceled(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aborted := make(chan string, 1)
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.Accept()
+		if err != nil {
+			s.Reply(StatusCanNotOpenDataConnection, err.Error())
+			return
+		}
+		conn.Write([]byte("-rw-r--r--    1 110      1002          951 Dec 02  2009 first.txt\r\n"))
+		// the rest of the listing never comes, and the context is canceled
+		// once the client reads it
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		line, _ := s.proto.ReadLine()
+		aborted <- line
+		conn.Close()
+		s.Reply(StatusTransfertAborted, "Transfer aborted")
+		s.Reply(StatusClosingDataConnection, "ABOR successful")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, err := c.ListContext(ctx, "/pub")
+	if err != context.Canceled {
+		t.Fatalf("got error %v, expected %v", err, context.Canceled)
+	}
+	if entries != nil {
+		t.Errorf("got entries %v after the cancellation", entries)
+	}
+	if line := <-aborted; line != "ABOR" {
+		t.Errorf("got command %q, expected ABOR", line)
+	}
+	// the control connection is still in sync
+	if _, err = c.CurrentDir(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListContextDeadline(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.Accept()
+		if err != nil {
+			s.Reply(StatusCanNotOpenDataConnection, err.Error())
+			return
+		}
+		s.proto.ReadLine()
+		conn.Close()
+		s.Reply(StatusTransfertAborted, "Transfer aborted")
+		s.Reply(StatusClosingDataConnection, "ABOR successful")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = c.ListContext(ctx, "/pub"); err != context.DeadlineExceeded {
+		t.Fatalf("got error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if _, err = c.CurrentDir(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListContextReplyDeadline(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	release := make(chan struct{})
+	defer close(release)
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		select {
+		case <-release:
+		case <-time.After(3 * time.Second):
+		}
+		s.Reply(StatusCanNotOpenDataConnection, "late")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = c.ListContext(ctx, "/pub"); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ListContext returned after %v, expected the deadline to bound the reply", elapsed)
+	}
+}
+
+func TestListContextDone(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub", "-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg")
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, err := c.ListContext(context.Background(), "/pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "welcome.msg" {
+		t.Errorf("got entries %v", entries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sent := len(mock.Commands())
+	if _, err = c.ListContext(ctx, "/pub"); err != context.Canceled {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+	if commands := mock.Commands(); len(commands) != sent {
+		t.Errorf("got commands %v with a canceled context", commands[sent:])
+	}
+}
+
+func TestContextBudget(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	// each phase fits in the budget, but not both
+	mock.Handle("FEAT", func(s *mockSession, arg string) {
+		time.Sleep(150 * time.Millisecond)
+		s.handle("FEAT", arg)
+	})
+	mock.Handle("USER", func(s *mockSession, arg string) {
+		time.Sleep(150 * time.Millisecond)
+		s.handle("USER", arg)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	c, err := DialContext(ctx, mock.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if err = c.LoginContext(ctx, "anonymous", "anonymous"); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, expected context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 140*time.Millisecond {
+		t.Errorf("login gave up after %v, beyond the remaining budget", elapsed)
+	}
+
+	cfg := Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous"}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c2, err := cfg.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+}
+
+func TestRetrContextCanceled(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("RETR", func(s *mockSession, arg string) {
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.Accept()
+		if err != nil {
+			s.Reply(StatusCanNotOpenDataConnection, err.Error())
+			return
+		}
+		conn.Write([]byte(testData))
+		// the transfer stalls until ABOR
+		s.proto.ReadLine()
+		conn.Close()
+		s.Reply(StatusTransfertAborted, "Transfer aborted")
+		s.Reply(StatusClosingDataConnection, "ABOR successful")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := c.RetrContext(ctx, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(testData))
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err = r.Read(buf); err != context.Canceled {
+		t.Errorf("Read: got error %v, expected %v", err, context.Canceled)
+	}
+	if err = r.Close(); err != context.Canceled {
+		t.Errorf("Close: got error %v, expected %v", err, context.Canceled)
+	}
+	if _, err = c.CurrentDir(); err != nil {
+		t.Error(err)
+	}
+}
+
+// cancelingReader cancels its context once its data was read, and blocks a
+// moment for the cancellation to be noticed.
+type cancelingReader struct {
+	data   []byte
+	cancel func()
+}
+
+func (cr *cancelingReader) Read(buf []byte) (int, error) {
+	if len(cr.data) == 0 {
+		cr.cancel()
+		time.Sleep(50 * time.Millisecond)
+		return copy(buf, testData), nil
+	}
+	n := copy(buf, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+func TestStorContextCanceled(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = c.StorContext(ctx, "file", &cancelingReader{data: []byte(testData), cancel: cancel})
+	if err != context.Canceled {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+	if _, err = c.CurrentDir(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorContextDeadline(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	release := make(chan struct{})
+	defer close(release)
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		select {
+		case <-release:
+		case <-time.After(3 * time.Second):
+		}
+		s.Reply(StatusCanNotOpenDataConnection, "late")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = c.StorContext(ctx, "file", bytes.NewBufferString(testData)); err != context.DeadlineExceeded {
+		t.Errorf("got error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("StorContext returned after %v, expected the deadline to bound the reply", elapsed)
+	}
+}
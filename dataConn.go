@@ -15,14 +15,18 @@
 package ftp
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // epsv issues an "EPSV" command to get a port number for a data connection.
-func (c *client) epsv() (port int, err error) {
+func (c *Client) epsv() (port int, err error) {
 	_, line, err := c.cmd(StatusExtendedPassiveMode, "EPSV")
 	if err != nil {
 		return
@@ -39,7 +43,7 @@ func (c *client) epsv() (port int, err error) {
 }
 
 // pasv issues a "PASV" command to get a port number for a data connection.
-func (c *client) pasv() (port int, err error) {
+func (c *Client) pasv() (port int, err error) {
 	_, line, err := c.cmd(StatusPassiveMode, "PASV")
 	if err != nil {
 		return
@@ -56,6 +60,12 @@ func (c *client) pasv() (port int, err error) {
 	if len(pasvData) < 6 {
 		return 0, errors.New("Invalid PASV response format")
 	}
+	if c.strictDataHost {
+		ip := net.ParseIP(strings.Join(pasvData[:4], "."))
+		if !ip.Equal(net.ParseIP(c.host)) {
+			return 0, ErrDataHostMismatch
+		}
+	}
 	// Let's compute the port number
 	portPart1, err1 := strconv.Atoi(pasvData[4])
 	if err1 != nil {
@@ -73,24 +83,251 @@ func (c *client) pasv() (port int, err error) {
 	return
 }
 
-// getDataConnPort returns a port for a new data connection
+// PassiveMode describes how the port of the data connections is negotiated.
+type PassiveMode int
+
+// The passive modes supported by SetPassiveMode
+const (
+	// EPSVFirst tries EPSV, and falls back to PASV for good if it fails.
+	EPSVFirst PassiveMode = iota
+	// PASVFirst tries PASV, and falls back to EPSV if it fails.
+	PASVFirst
+	// EPSVOnly and PASVOnly only use the given command.
+	EPSVOnly
+	PASVOnly
+)
+
+// passiveModes are the names of the passive modes.
+var passiveModes = map[string]PassiveMode{
+	"EPSVFirst": EPSVFirst,
+	"PASVFirst": PASVFirst,
+	"EPSVOnly":  EPSVOnly,
+	"PASVOnly":  PASVOnly,
+}
+
+// parsePassiveMode returns the passive mode named name.
+func parsePassiveMode(name string) (PassiveMode, error) {
+	mode, ok := passiveModes[name]
+	if !ok {
+		return 0, errors.New("Unknown passive mode: " + name)
+	}
+	return mode, nil
+}
+
+// SetPassiveMode selects how the port of the data connections is negotiated,
+// EPSVFirst being the default. PASVFirst is a workaround for servers behind
+// NAT whose EPSV replies are not reachable.
+func (c *Client) SetPassiveMode(mode PassiveMode) {
+	c.passiveMode = mode
+}
+
+// DisableEPSV makes the data connections negotiated with PASV only, saving
+// the failed EPSV command of the servers which do not implement it. It is a
+// shorthand for SetPassiveMode(PASVOnly).
+func (c *Client) DisableEPSV() {
+	c.passiveMode = PASVOnly
+}
+
+// WithoutEPSV disables EPSV from the first data connection, see DisableEPSV.
+func WithoutEPSV() Option {
+	return func(c *Client) {
+		c.DisableEPSV()
+	}
+}
+
+// SetStrictDataHost makes the client check that the address advertised by
+// the PASV replies is the one of the server, failing with ErrDataHostMismatch
+// otherwise.
+//
+// The data connections are always opened to the address of the control
+// connection, whatever the PASV replies say, so that a malicious server can
+// not make the client connect to a third host, a variant of the FTP bounce
+// attack. The strict check goes further and rejects the servers which
+// advertise another address, at the cost of the servers behind a NAT which
+// advertise their private address.
+func (c *Client) SetStrictDataHost(strict bool) {
+	c.strictDataHost = strict
+}
+
+// SetTransferBufferSize sets the size of the buffer used to copy the data of
+// the uploads, and of the downloads made by the helpers such as
+// ListAndDownload, along with the socket buffers of the data connections.
+// Large buffers reduce the overhead of fast transfers. The default of 0 keeps
+// the buffering of io.Copy and of the system.
+func (c *Client) SetTransferBufferSize(size int) {
+	c.bufferSize = size
+}
+
+// copy is io.Copy with the buffer size set by SetTransferBufferSize.
+func (c *Client) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if c.bufferSize <= 0 {
+		return io.Copy(dst, src)
+	}
+	// hide io.ReaderFrom and io.WriterTo, which would bypass the buffer
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, make([]byte, c.bufferSize))
+}
+
+// getDataConnPort returns a port for a new data connection, along with the
+// command which negotiated it
 // it uses the best available method to do so
-func (c *client) getDataConnPort() (int, error) {
+func (c *Client) getDataConnPort() (int, string, error) {
+	switch c.passiveMode {
+	case EPSVOnly:
+		return c.withMethod("EPSV", c.epsv)
+	case PASVOnly:
+		return c.withMethod("PASV", c.pasv)
+	case PASVFirst:
+		if port, err := c.pasv(); err == nil {
+			return port, "PASV", nil
+		}
+		return c.withMethod("EPSV", c.epsv)
+	}
 	if !c.unepsv {
 		if port, err := c.epsv(); err == nil {
-			return port, nil
+			return port, "EPSV", nil
 		}
 		// if there is an error, disable EPSV for the next attempts
 		c.unepsv = true
 	}
-	return c.pasv()
+	return c.withMethod("PASV", c.pasv)
+}
+
+// withMethod calls the negotiation function of method.
+func (c *Client) withMethod(method string, negotiate func() (int, error)) (int, string, error) {
+	port, err := negotiate()
+	return port, method, err
 }
 
 // openDataConn creates a new FTP data connection.
-func (c *client) openDataConn() (net.Conn, error) {
-	port, err := c.getDataConnPort()
+func (c *Client) openDataConn() (net.Conn, error) {
+	port, method, err := c.getDataConnPort()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(c.host, strconv.Itoa(port))
+	c.event(Event{Type: EventDataConnection, Method: method, Addr: addr})
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return c.setupDataConn(conn), nil
+}
+
+// setupDataConn sizes the socket buffers of a new data connection, and
+// wraps it with TLS when the data is protected.
+func (c *Client) setupDataConn(conn net.Conn) net.Conn {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && c.bufferSize > 0 {
+		tcpConn.SetReadBuffer(c.bufferSize)
+		tcpConn.SetWriteBuffer(c.bufferSize)
+	}
+	if c.protLevel == ProtPrivate {
+		return tls.Client(conn, c.tlsConfig)
+	}
+	return conn
+}
+
+// SetActiveMode makes the server open the data connections to the client,
+// which listens on the address of its end of the control connection and
+// announces it with an EPRT FTP command over IPv6 or when the server
+// advertises it, a PORT FTP command otherwise, instead of negotiating a
+// passive port. It is meant for the servers whose passive ports are not reachable,
+// as the client must then accept connections from the server.
+func (c *Client) SetActiveMode(enable bool) {
+	c.activeMode = enable
+}
+
+// openActiveDataConn listens for a data connection from the server and
+// announces it with an EPRT or PORT FTP command.
+func (c *Client) openActiveDataConn() (net.Listener, error) {
+	local, ok := c.netConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("Active mode requires a TCP control connection")
+	}
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	_, eprt := c.features["EPRT"]
+	switch {
+	case addr.IP.To4() == nil:
+		err = c.eprt(addr)
+	case eprt:
+		// like EPSV, fall back to the older command if it fails
+		if err = c.eprt(addr); err != nil {
+			err = c.port(addr)
+		}
+	default:
+		err = c.port(addr)
+	}
 	if err != nil {
+		ln.Close()
 		return nil, err
 	}
-	return net.DialTimeout("tcp", net.JoinHostPort(c.host, strconv.Itoa(port)), c.timeout)
+	return ln, nil
+}
+
+// eprt issues an EPRT FTP command announcing addr for a data connection.
+// EPRT is described in RFC 2428
+func (c *Client) eprt(addr *net.TCPAddr) error {
+	_, _, err := c.cmd(StatusCommandOK, "EPRT %s", formatEPRT(addr))
+	return err
+}
+
+// port issues a PORT FTP command announcing the IPv4 address addr for a data
+// connection.
+func (c *Client) port(addr *net.TCPAddr) error {
+	_, _, err := c.cmd(StatusCommandOK, "PORT %s", formatPORT(addr))
+	return err
+}
+
+// formatEPRT formats the argument of EPRT, such as "|1|10.0.0.1|2049|" or
+// "|2|::1|2049|".
+func formatEPRT(addr *net.TCPAddr) string {
+	family := 2
+	if addr.IP.To4() != nil {
+		family = 1
+	}
+	return fmt.Sprintf("|%d|%s|%d|", family, addr.IP, addr.Port)
+}
+
+// formatPORT formats the argument of PORT, such as "10,0,0,1,8,1" for port
+// 2049.
+func formatPORT(addr *net.TCPAddr) string {
+	ip := addr.IP.To4()
+	return fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], addr.Port/256, addr.Port%256)
+}
+
+// acceptDataConn accepts the data connection opened by the server in active
+// mode, waiting no longer than the timeout of the client. The connections
+// from other hosts than the server are closed, as anyone could connect to
+// the announced port to steal or inject the data.
+func (c *Client) acceptDataConn(ln net.Listener) (net.Conn, error) {
+	defer ln.Close()
+	if tcpLn, ok := ln.(*net.TCPListener); ok && c.timeout > 0 {
+		tcpLn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	server := c.peerIP()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && server != nil && !addr.IP.Equal(server) {
+			c.failed("accept", fmt.Errorf("%w: %s", ErrDataHostMismatch, addr))
+			conn.Close()
+			continue
+		}
+		c.event(Event{Type: EventDataConnection, Method: "PORT", Addr: conn.RemoteAddr().String()})
+		return c.setupDataConn(conn), nil
+	}
+}
+
+// peerIP returns the IP address of the server on the control connection,
+// nil when unknown.
+func (c *Client) peerIP() net.IP {
+	if addr, ok := c.netConn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return net.ParseIP(c.host)
 }
@@ -0,0 +1,97 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"compress/zlib"
+	"io"
+	"net"
+	"strings"
+)
+
+// SetCompression issues a MODE Z FTP command to compress the data
+// connections with deflate, or a MODE S FTP command to go back to the
+// default stream mode.
+//
+// When the server does not advertise MODE Z, the client transparently stays
+// in stream mode.
+func (c *Client) SetCompression(enable bool) error {
+	if !enable {
+		if c.transferMode != ModeDeflate {
+			return nil
+		}
+		return c.SetTransferMode(ModeStream)
+	}
+	if !strings.Contains(c.features["MODE"], "Z") {
+		return nil
+	}
+	if err := c.SetTransferMode(ModeDeflate); err != ErrUnsupported {
+		return err
+	}
+	return nil
+}
+
+// deflateConn is a data connection in MODE Z, the data being compressed in
+// the zlib format.
+type deflateConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *zlib.Writer
+}
+
+// Read decompresses the data received.
+func (d *deflateConn) Read(buf []byte) (int, error) {
+	if d.r == nil {
+		r, err := zlib.NewReader(d.Conn)
+		if err != nil {
+			return 0, err
+		}
+		d.r = r
+	}
+	return d.r.Read(buf)
+}
+
+// Write compresses the data sent.
+func (d *deflateConn) Write(buf []byte) (int, error) {
+	if d.w == nil {
+		d.w = zlib.NewWriter(d.Conn)
+	}
+	return d.w.Write(buf)
+}
+
+// endOfFile ends the compressed stream, which is sent even for an empty file.
+func (d *deflateConn) endOfFile() error {
+	if d.w == nil {
+		d.w = zlib.NewWriter(d.Conn)
+	}
+	err := d.w.Close()
+	d.w = nil
+	return err
+}
+
+// Close flushes the compressed data and closes the connection.
+func (d *deflateConn) Close() error {
+	var err error
+	if d.w != nil {
+		err = d.w.Close()
+	}
+	if d.r != nil {
+		d.r.Close()
+	}
+	if err2 := d.Conn.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "MODE Z")
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetCompression(true); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte(testData+"\n"), 1000)
+	if err = c.Stor("text", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := mock.File("text"); !bytes.Equal(remote, data) {
+		t.Error("remote file differs from the uploaded one")
+	}
+	if wire := mock.WireBytes(); wire >= int64(len(data)) {
+		t.Errorf("%d bytes on the wire for %d bytes of data", wire, len(data))
+	}
+
+	r, err := c.Retr("text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("downloaded file differs from the remote one")
+	}
+
+	if err = c.Stor("empty", bytes.NewReader(nil)); err != nil {
+		t.Error(err)
+	}
+	if err = c.SetCompression(false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompressionUnsupported(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetCompression(true); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Stor("text", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := mock.File("text"); string(remote) != testData {
+		t.Errorf("remote file %q, expected %q", remote, testData)
+	}
+}
+
+func BenchmarkStorCompression(b *testing.B) {
+	for _, compression := range []bool{false, true} {
+		name := "stream"
+		if compression {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			mock := newFtpMock(nil)
+			defer mock.Close()
+			mock.features = append(mock.features, "MODE Z")
+
+			c, err := DialTimeout(mock.Addr(), 5*time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			if err = c.SetCompression(compression); err != nil {
+				b.Fatal(err)
+			}
+
+			data := bytes.Repeat([]byte("2017-04-12 10:00:00 INFO request served in 12ms\n"), 20000)
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = c.Stor("log", bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(mock.WireBytes())/float64(b.N), "wire-bytes/op")
+		})
+	}
+}
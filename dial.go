@@ -15,59 +15,195 @@
 package ftp
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/textproto"
 	"time"
 )
 
+// Option configures a client before it connects to the server.
+type Option func(c *Client)
+
+// WithEventHandler sets the handler receiving the events of the connection,
+// starting with its establishment. See SetEventHandler.
+func WithEventHandler(handler func(Event)) Option {
+	return func(c *Client) {
+		c.eventHandler = handler
+	}
+}
+
+// WithAnonymousPassword sets the password sent by LoginAnonymous, an email
+// address by convention, which some servers require.
+func WithAnonymousPassword(password string) Option {
+	return func(c *Client) {
+		c.anonymousPassword = password
+	}
+}
+
+// WithConnHook sets a hook called with the control connection right after
+// it is established, before anything is exchanged, to configure the socket
+// or wrap the connection, for instance to count the bytes or trace the
+// exchanges. The connection returned by hook is used instead, and the dial
+// fails if hook returns an error.
+func WithConnHook(hook func(net.Conn) (net.Conn, error)) Option {
+	return func(c *Client) {
+		c.connHook = hook
+	}
+}
+
+// WithPreLogin sets a hook called by Login before the USER FTP command, to
+// send the commands some servers require beforehand with RawCmd, such as a
+// SITE command carrying a token. Login fails if hook returns an error.
+func WithPreLogin(hook func(c *Client) error) Option {
+	return func(c *Client) {
+		c.preLogin = hook
+	}
+}
+
+// WithPostLogin sets a hook called by Login once the user is authenticated,
+// before the session is set up. Login fails if hook returns an error.
+func WithPostLogin(hook func(c *Client) error) Option {
+	return func(c *Client) {
+		c.postLogin = hook
+	}
+}
+
 // Dial is like DialTimeout with no timeout
-func Dial(addr string) (*client, error) {
-	return DialTimeout(addr, 0)
+func Dial(addr string, opts ...Option) (*Client, error) {
+	return DialTimeout(addr, 0, opts...)
 }
 
 // DialTimeout initializes the connection to the specified ftp server address.
 //
 // It is generally followed by a call to Login() as most FTP commands require
 // an authenticated user.
-func DialTimeout(addr string, timeout time.Duration) (*client, error) {
-	tconn, err := net.DialTimeout("tcp", addr, timeout)
+func DialTimeout(addr string, timeout time.Duration, opts ...Option) (*Client, error) {
+	return dialContext(context.Background(), addr, timeout, opts)
+}
+
+// dialContext initializes the connection to the server within ctx.
+func dialContext(ctx context.Context, addr string, timeout time.Duration, opts []Option) (*Client, error) {
+	c, err := dial(ctx, addr, timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = c.withContext(ctx, c.setup)
 	if err != nil {
+		c.Close()
+		return nil, c.failed("dial", err)
+	}
+	return c, nil
+}
+
+// dial creates a client and opens its control connection within ctx.
+func dial(ctx context.Context, addr string, timeout time.Duration, opts []Option) (*Client, error) {
+	c := &Client{
+		timeout:  timeout,
+		features: make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.connect(ctx, addr); err != nil {
 		return nil, err
 	}
+	return c, nil
+}
+
+// connect opens the control connection and reads the welcome message of the
+// remote FTP server within ctx.
+func (c *Client) connect(ctx context.Context, addr string) error {
+	c.event(Event{Type: EventConnectStart, Addr: addr})
+
+	dialer := net.Dialer{Timeout: c.timeout}
+	tconn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return c.failed("dial", err)
+	}
 	// Use the resolved IP address in case addr contains a domain name
 	// If we use the domain name, we might not resolve to the same IP.
 	host, _, err := net.SplitHostPort(tconn.RemoteAddr().String())
 	if err != nil {
-		return nil, err
+		tconn.Close()
+		return c.failed("dial", err)
 	}
-	c := &client{
-		host:     host,
-		timeout:  timeout,
-		conn:     textproto.NewConn(tconn),
-		features: make(map[string]string),
+	if c.connHook != nil {
+		conn, err := c.connHook(tconn)
+		if err != nil {
+			tconn.Close()
+			return c.failed("dial", err)
+		}
+		tconn = conn
 	}
-	_, _, err = c.conn.ReadResponse(StatusReady)
+	c.addr = addr
+	c.host = host
+	c.netConn = tconn
+	c.conn = textproto.NewConn(tconn)
+
+	var banner string
+	err = c.withContext(ctx, func() (err error) {
+		_, banner, err = c.conn.ReadResponse(StatusReady)
+		return err
+	})
 	if err != nil {
 		c.Close()
-		return nil, err
+		return c.failed("dial", err)
 	}
-	err = c.feat()
+	c.banner = banner
+	return nil
+}
+
+// setup discovers the features supported by the remote FTP server.
+func (c *Client) setup() error {
+	err := c.feat()
 	if err != nil {
-		c.Close()
-		return nil, err
+		return err
 	}
 	if _, mlst := c.features["MLST"]; mlst {
 		c.mlst = true
 	}
-	return c, nil
+	return nil
 }
 
 // Login authenticates the client with specified user and password.
 //
 // "anonymous"/"anonymous" is a common user/password scheme for FTP servers
 // that allows anonymous read-only accounts.
-func (c *client) Login(user, password string) error {
+func (c *Client) Login(user, password string) error {
+	err := c.login(user, password)
+	if err != nil {
+		return c.failed("login", err)
+	}
+	// the helpers of Config dial the same server with the same settings
+	if c.Config.Addr == "" {
+		c.Config.Addr = c.addr
+	}
+	if c.tlsConfig != nil {
+		c.Config.TLS = true
+	}
+	c.Config.User = user
+	c.Config.Pass = password
+	c.event(Event{Type: EventLoginSuccess, User: user})
+	return nil
+}
+
+// LoginAnonymous logs in as the "anonymous" user, with the password set by
+// the WithAnonymousPassword option, "anonymous@" by default.
+func (c *Client) LoginAnonymous() error {
+	password := c.anonymousPassword
+	if password == "" {
+		password = "anonymous@"
+	}
+	return c.Login("anonymous", password)
+}
+
+func (c *Client) login(user, password string) error {
+	if c.preLogin != nil {
+		if err := c.preLogin(c); err != nil {
+			return err
+		}
+	}
 	code, message, err := c.cmd(-1, "USER %s", user)
 	if err != nil {
 		return err
@@ -80,18 +216,194 @@ func (c *client) Login(user, password string) error {
 			return err
 		}
 	default:
-		return errors.New(message)
+		return &textproto.Error{Code: code, Msg: message}
+	}
+	if c.postLogin != nil {
+		if err = c.postLogin(c); err != nil {
+			return err
+		}
 	}
 	// Switch to binary mode
 	if _, _, err = c.cmd(StatusCommandOK, "TYPE I"); err != nil {
 		return err
 	}
 	// Switch to UTF-8
-	return c.setUTF8()
+	if err = c.setUTF8(); err != nil {
+		return err
+	}
+	return c.protectData()
+}
+
+// Reauthenticate logs in as another user on the same connection: a REIN FTP
+// command resets the session before the usual login sequence. The features
+// of the server are discovered again, as they may depend on the account.
+//
+// The client reconnects instead when the server does not implement REIN, and
+// over TLS, as REIN would also reset the security of the control connection.
+func (c *Client) Reauthenticate(user, password string) error {
+	reinitialized := false
+	if c.tlsConfig == nil {
+		_, _, err := c.cmd(StatusReady, "REIN")
+		if err != nil && unsupported(err) != ErrUnsupported {
+			return err
+		}
+		reinitialized = err == nil
+	}
+	if !reinitialized {
+		if err := c.reconnect(); err != nil {
+			return err
+		}
+	}
+	return c.restoreSession(user, password)
+}
+
+// restoreSession logs in on a connection which was reinitialized or opened
+// again, restoring the data protection, clear command channel, transfer mode
+// and hash algorithm of the previous session.
+func (c *Client) restoreSession(user, password string) error {
+	level, mode, algo, ccc := c.protLevel, c.transferMode, c.hashAlgo, c.clearCommand
+	c.mlst = false
+	c.unepsv = false
+	c.protLevel = ""
+	c.transferMode = ""
+	c.hashAlgo = ""
+	c.clearCommand = false
+	c.features = make(map[string]string)
+	if err := c.setup(); err != nil {
+		return err
+	}
+	if err := c.Login(user, password); err != nil {
+		return err
+	}
+	if level != "" {
+		if err := c.SetDataProtection(level); err != nil {
+			return err
+		}
+	}
+	if ccc {
+		if err := c.ClearCommandChannel(); err != nil {
+			return err
+		}
+	}
+	if mode != "" {
+		if err := c.SetTransferMode(mode); err != nil {
+			return err
+		}
+	}
+	if algo != "" {
+		return c.SetHashAlgo(algo)
+	}
+	return nil
+}
+
+// reconnect closes the control connection and opens a new one to the same
+// server, securing it again when TLS is used.
+func (c *Client) reconnect() error {
+	c.conn.Cmd("QUIT")
+	c.conn.Close()
+
+	if err := c.connect(context.Background(), c.addr); err != nil {
+		return err
+	}
+	if c.tlsConfig != nil {
+		if err := c.authTLS(c.addr, c.tlsConfig); err != nil {
+			c.Close()
+			return c.failed("dial", err)
+		}
+	}
+	return nil
+}
+
+// Clone opens a second, independent connection to the same server, set up
+// like this one: same timeouts, TLS configuration, data protection, passive
+// mode and options, and logged in with the same credentials.
+func (c *Client) Clone() (*Client, error) {
+	clone := &Client{
+		passiveMode:       c.passiveMode,
+		dirEntries:        c.dirEntries,
+		timeout:           c.timeout,
+		features:          make(map[string]string),
+		keepAliveInterval: c.keepAliveInterval,
+		commandTimeout:    c.commandTimeout,
+		eventHandler:      c.eventHandler,
+		certFingerprint:   c.certFingerprint,
+		closeBehavior:     c.closeBehavior,
+		anonymousPassword: c.anonymousPassword,
+		verifyRestart:     c.verifyRestart,
+		bufferSize:        c.bufferSize,
+		listAll:           c.listAll,
+		maxPathLength:     c.maxPathLength,
+		fileMode:          c.fileMode,
+		dirMode:           c.dirMode,
+		strictDataHost:    c.strictDataHost,
+		preciseTimes:      c.preciseTimes,
+		verifySize:        c.verifySize,
+		postStorVerify:    c.postStorVerify,
+		activeMode:        c.activeMode,
+		caseInsensitive:   c.caseInsensitive,
+		connHook:          c.connHook,
+		preLogin:          c.preLogin,
+		postLogin:         c.postLogin,
+
+		unsolicitedHandler: c.unsolicitedHandler,
+	}
+	for command, codes := range c.acceptedCodes {
+		clone.SetAcceptedCodes(command, codes...)
+	}
+	if err := clone.connect(context.Background(), c.addr); err != nil {
+		return nil, err
+	}
+	if c.tlsConfig != nil {
+		if err := clone.authTLS(c.addr, c.tlsConfig); err != nil {
+			clone.Close()
+			return nil, clone.failed("dial", err)
+		}
+	}
+	if err := clone.setup(); err != nil {
+		clone.Close()
+		return nil, clone.failed("dial", err)
+	}
+	clone.mlst = c.mlst
+	clone.unepsv = c.unepsv
+
+	if c.User != "" {
+		if err := clone.Login(c.User, c.Pass); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	if c.protLevel != "" {
+		if err := clone.SetDataProtection(c.protLevel); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	if c.clearCommand {
+		if err := clone.ClearCommandChannel(); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	if c.transferMode != "" {
+		if err := clone.SetTransferMode(c.transferMode); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	if c.listCache != nil {
+		clone.EnableListCache(c.listCache.ttl)
+	}
+	if c.hashAlgo != "" {
+		if err := clone.SetHashAlgo(c.hashAlgo); err != nil {
+			clone.Close()
+			return nil, err
+		}
+	}
+	return clone, nil
 }
 
 // setUTF8 issues an "OPTS UTF8 ON" command.
-func (c *client) setUTF8() error {
+func (c *Client) setUTF8() error {
 	if _, ok := c.features["UTF8"]; !ok {
 		return nil
 	}
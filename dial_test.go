@@ -15,6 +15,12 @@
 package ftp
 
 import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -61,3 +67,209 @@ func TestWrongLogin(t *testing.T) {
 		t.Fatal("expected error, got nil")
 	}
 }
+
+func TestReauthenticate(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	c.unepsv = true
+	if err = c.Reauthenticate("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if c.unepsv {
+		t.Error("EPSV support not reset")
+	}
+	if !containsCommand(mock.Commands(), "REIN") || containsCommand(mock.Commands(), "QUIT") {
+		t.Errorf("expected REIN on the same connection, got %v", mock.Commands())
+	}
+
+	// without REIN, the client reconnects
+	mock.Handle("REIN", func(s *mockSession, arg string) {
+		s.Reply(StatusNotImplemented, "REIN not implemented")
+	})
+	if err = c.Reauthenticate("carol", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !containsCommand(mock.Commands(), "QUIT") {
+		t.Errorf("expected a reconnection, got %v", mock.Commands())
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+	if commands := mock.Commands(); !containsCommand(commands[len(commands)-6:], "USER carol") {
+		t.Errorf("expected a login as carol, got %v", commands)
+	}
+}
+
+func TestClone(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+
+	c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetDataProtection(ProtPrivate); err != nil {
+		t.Fatal(err)
+	}
+	c.SetPassiveMode(PASVOnly)
+
+	clone, err := c.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clone.Close()
+	if clone.netConn == c.netConn {
+		t.Fatal("the clone shares the control connection")
+	}
+	if clone.passiveMode != PASVOnly || clone.protLevel != ProtPrivate {
+		t.Errorf("clone not set up like the original: %+v", clone)
+	}
+	if err = clone.Stor("file", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if dataTLS := mock.DataTLS(); len(dataTLS) != 1 || !dataTLS[0] {
+		t.Errorf("data connections encryption = %v, expected [true]", dataTLS)
+	}
+
+	users := 0
+	for _, cmd := range mock.Commands() {
+		if cmd == "USER alice" {
+			users++
+		}
+	}
+	if users != 2 {
+		t.Errorf("logged in %d times as alice, expected twice", users)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginAnonymous(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.LoginAnonymous(); err != nil {
+		t.Error(err)
+	}
+	c.Close()
+
+	c, err = DialTimeout(mock.Addr(), 5*time.Second, WithAnonymousPassword("ops@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.LoginAnonymous(); err != nil {
+		t.Error(err)
+	}
+
+	commands := mock.Commands()
+	if !containsCommand(commands, "PASS anonymous@") || !containsCommand(commands, "PASS ops@example.com") {
+		t.Errorf("unexpected passwords in %v", commands)
+	}
+}
+
+// containsCommand reports whether command is one of commands.
+func containsCommand(commands []string, command string) bool {
+	for _, c := range commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	read int64
+}
+
+func (c *countingConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func TestConnHook(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	var counter *countingConn
+	c, err := DialTimeout(mock.Addr(), 5*time.Second, WithConnHook(func(conn net.Conn) (net.Conn, error) {
+		counter = &countingConn{Conn: conn}
+		return counter, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.NoOp(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&counter.read) == 0 {
+		t.Error("the control connection was not wrapped")
+	}
+
+	errHook := errors.New("hook failed")
+	_, err = DialTimeout(mock.Addr(), 5*time.Second, WithConnHook(func(conn net.Conn) (net.Conn, error) {
+		return nil, errHook
+	}))
+	if err != errHook {
+		t.Errorf("got error %v, expected the error of the hook", err)
+	}
+}
+
+func TestLoginHooks(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandOK, "OK")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second,
+		WithPreLogin(func(c *Client) error {
+			_, _, err := c.RawCmd("SITE TOKEN secret")
+			return err
+		}),
+		WithPostLogin(func(c *Client) error {
+			_, _, err := c.RawCmd("SITE WHOAMI")
+			return err
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	var sequence []string
+	for _, cmd := range mock.Commands() {
+		if strings.HasPrefix(cmd, "SITE") || strings.HasPrefix(cmd, "USER") || strings.HasPrefix(cmd, "PASS") {
+			sequence = append(sequence, cmd)
+		}
+	}
+	expected := []string{"SITE TOKEN secret", "USER anonymous", "PASS anonymous", "SITE WHOAMI"}
+	if !reflect.DeepEqual(sequence, expected) {
+		t.Errorf("got commands %v, expected %v", sequence, expected)
+	}
+}
@@ -0,0 +1,83 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"time"
+)
+
+// EventType describes the different types of an Event.
+type EventType int
+
+// The differents types of an Event
+const (
+	EventConnectStart EventType = iota
+	EventLoginSuccess
+	EventTransferStart
+	EventTransferComplete
+	EventError
+	EventDataConnection
+)
+
+// Event describes something which happened on a connection. Only the fields
+// relevant to its type are set.
+type Event struct {
+	Type EventType
+
+	// Addr is the address being dialed, for EventConnectStart and
+	// EventDataConnection.
+	Addr string
+	// Method is the command which negotiated the data connection ("EPSV"
+	// or "PASV"), for EventDataConnection.
+	Method string
+	// User is the authenticated user, for EventLoginSuccess.
+	User string
+
+	// Path is the remote file of EventTransferStart and EventTransferComplete.
+	Path string
+	// Size is the size of the transfer when known in advance, -1 otherwise.
+	Size int64
+	// Bytes and Duration describe a complete transfer.
+	Bytes    int64
+	Duration time.Duration
+
+	// Op is the failed operation ("dial", "login", "stor", "retr",
+	// "chmod", "close", "accept") and Err the error it returned, for
+	// EventError.
+	Op  string
+	Err error
+}
+
+// SetEventHandler sets the handler receiving the events of the connection.
+// It is called synchronously, and may be nil to stop receiving events.
+// Use the WithEventHandler option to also receive the dial events.
+func (c *Client) SetEventHandler(handler func(Event)) {
+	c.eventHandler = handler
+}
+
+// event passes e to the event handler, if any.
+func (c *Client) event(e Event) {
+	if c.eventHandler != nil {
+		c.eventHandler(e)
+	}
+}
+
+// failed reports a failed operation to the event handler, and returns err.
+func (c *Client) failed(op string, err error) error {
+	if err != nil {
+		c.event(Event{Type: EventError, Op: op, Err: err})
+	}
+	return err
+}
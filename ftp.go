@@ -17,45 +17,207 @@ package ftp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/textproto"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type client struct {
-	mlst     bool
-	unepsv   bool
-	host     string
-	conn     *textproto.Conn
-	timeout  time.Duration
-	features map[string]string
+// Client is a connection to a FTP server, opened with Dial, DialTimeout,
+// DialTLS, DialContext, Config.Dial or NewClient.
+type Client struct {
+	stats connStats // first for the alignment of its 64-bit counters
 
-	ftpSrv `json:"ftpSrvOptions"`
+	mlst        bool
+	unepsv      bool
+	passiveMode PassiveMode
+	dirEntries  bool
+	addr        string
+	host        string
+	netConn     net.Conn
+	conn        *textproto.Conn
+	timeout     time.Duration
+	features    map[string]string
+	tlsConfig   *tls.Config
+	protLevel   ProtLevel
+
+	keepAliveInterval time.Duration
+	commandTimeout    time.Duration
+	suspect           bool
+	eventHandler      func(Event)
+	transferMode      TransferMode
+	restartMarker     string
+	certFingerprint   []byte
+	closeBehavior     CloseBehavior
+	anonymousPassword string
+	verifyRestart     bool
+	transferDone      bool
+	transferMu        sync.Mutex // guards the replies read during transfers
+	transferring      bool
+	statusNoops       int
+	finalReply        *textproto.Error
+	bufferSize        int
+	banner            string
+	hashAlgo          string
+	listAll           bool
+	listCache         *listCache
+	maxPathLength     int
+	fileMode          os.FileMode
+	dirMode           os.FileMode
+	chmodUnsupported  bool
+	strictDataHost    bool
+	preciseTimes      int
+	clearCommand      bool
+	verifySize        bool
+	postStorVerify    bool
+	activeMode        bool
+	caseInsensitive   bool
+	acceptedCodes     map[string][]int
+	connHook          func(net.Conn) (net.Conn, error)
+	preLogin          func(c *Client) error
+	postLogin         func(c *Client) error
+
+	unsolicitedHandler func(code int, msg string)
+
+	Config `json:"ftpSrvOptions"`
 }
 
-type ftpSrv struct {
+// Config describes the FTP server to connect to, as read by NewClient.
+type Config struct {
 	Addr string `json:"url"`
+	// Port is used when Addr does not specify one, 21 if unset.
+	Port int    `json:"port"`
 	User string `json:"user"`
 	Pass string `json:"pwd"`
+
+	// TLS secures the connection with explicit FTPS, see DialTLS, and
+	// SkipVerify disables the verification of the server certificate.
+	TLS        bool `json:"tls"`
+	SkipVerify bool `json:"skipVerify"`
+	// Timeout is a duration such as "30s", see DialTimeout.
+	Timeout string `json:"timeout"`
+	// PassiveMode is the name of a PassiveMode, such as "PASVOnly".
+	PassiveMode string `json:"passiveMode"`
 }
 
-// Close issues a REIN FTP command to logout the current user and
-// issues a QUIT FTP command to properly close the connection from
-// the remote FTP server.
-func (ftp *client) Close() (err error) {
-	_, _, reinErr := ftp.cmd(StatusReady, "REIN")
-	if reinErr != nil {
-		err = reinErr
+// address returns the host and port to dial.
+func (cfg Config) address() string {
+	if _, _, err := net.SplitHostPort(cfg.Addr); err == nil {
+		return cfg.Addr
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 21
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(cfg.Addr, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Dial connects to the configured server and logs in.
+func (cfg Config) Dial(opts ...Option) (*Client, error) {
+	return cfg.DialContext(context.Background(), opts...)
+}
+
+// DialContext is like Dial, but connecting and logging in are bounded by
+// ctx, see the package DialContext.
+func (cfg Config) DialContext(ctx context.Context, opts ...Option) (*Client, error) {
+	c, err := cfg.dial(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.LoginContext(ctx, cfg.User, cfg.Pass); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dial connects to the configured server within ctx.
+func (cfg Config) dial(ctx context.Context, opts []Option) (*Client, error) {
+	var timeout time.Duration
+	if cfg.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil {
+			return nil, err
+		}
+	}
+	var mode PassiveMode
+	if cfg.PassiveMode != "" {
+		var err error
+		if mode, err = parsePassiveMode(cfg.PassiveMode); err != nil {
+			return nil, err
+		}
+	}
+
+	var c *Client
+	var err error
+	if cfg.TLS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.SkipVerify}
+		c, err = dialTLSContext(ctx, cfg.address(), tlsConfig, timeout, opts)
+	} else {
+		c, err = dialContext(ctx, cfg.address(), timeout, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// an empty PassiveMode leaves the mode set by the options
+	if cfg.PassiveMode != "" {
+		c.SetPassiveMode(mode)
 	}
-	_, quitErr := ftp.conn.Cmd("QUIT")
-	if quitErr != nil {
+	c.Config = cfg
+	return c, nil
+}
+
+// CloseBehavior describes the commands sent by Close.
+type CloseBehavior int
+
+// The behaviors of Close
+const (
+	// QuitOnly sends a QUIT FTP command without waiting for its reply, the
+	// default.
+	QuitOnly CloseBehavior = iota
+	// ReinThenQuit logs out the user with a REIN FTP command before QUIT.
+	ReinThenQuit
+	// QuitAndWait sends a QUIT FTP command and waits for its reply, so that
+	// the server is done with the session when Close returns.
+	QuitAndWait
+)
+
+// SetCloseBehavior sets the commands sent by Close.
+func (ftp *Client) SetCloseBehavior(behavior CloseBehavior) {
+	ftp.closeBehavior = behavior
+}
+
+// Close issues a QUIT FTP command to properly close the connection from
+// the remote FTP server, after a REIN FTP command to logout the current
+// user with ReinThenQuit. See SetCloseBehavior.
+func (ftp *Client) Close() (err error) {
+	if ftp.closeBehavior == ReinThenQuit {
+		_, _, reinErr := ftp.cmd(StatusReady, "REIN")
+		if reinErr != nil {
+			err = reinErr
+		}
+	}
+	if ftp.closeBehavior == QuitAndWait {
+		_, _, err = ftp.cmd(StatusClosing, "QUIT")
+	} else if _, quitErr := ftp.conn.Cmd("QUIT"); quitErr != nil {
 		err = quitErr
+	} else {
+		ftp.stats.sent()
 	}
 	closeErr := ftp.conn.Close()
 	if closeErr != nil {
@@ -65,7 +227,7 @@ func (ftp *client) Close() (err error) {
 }
 
 // NewClient initialize ftp from the configuration file
-func NewClient(path ...string) (*client, error) {
+func NewClient(path ...string) (*Client, error) {
 	cfg := "../config/system.config"
 
 	if path != nil && path[0] != "" {
@@ -75,15 +237,11 @@ func NewClient(path ...string) (*client, error) {
 	if err != nil {
 		return nil, errors.New("Read configuration file failed, " + err.Error())
 	}
-	ftp := new(client)
+	ftp := new(Client)
 	if err = json.Unmarshal(bytes, ftp); err != nil {
 		return nil, err
 	}
-	//the tcp connection address must be added to port 21
-	if !strings.HasSuffix(ftp.Addr, ":21") {
-		ftp.Addr += ":21"
-	}
-	conn, err := Dial(ftp.Addr)
+	conn, err := ftp.Config.dial(context.Background(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("Connection FTP failed,%s", err)
 	}
@@ -95,12 +253,12 @@ func NewClient(path ...string) (*client, error) {
 }
 
 // Delete delete the matching files in the specified directory
-func (ftp *client) Delete(dirName, fileName string) error {
+func (ftp *Client) Delete(dirName, fileName string) error {
 	conn, err := ftp.cmdDataConnFrom(0, "NLST %s", dirName)
 	if err != nil {
 		return err
 	}
-	rep := &response{conn, ftp}
+	rep := ftp.newResponse(conn)
 	defer rep.Close()
 
 	dirEmpty := true
@@ -119,7 +277,7 @@ func (ftp *client) Delete(dirName, fileName string) error {
 }
 
 // Upload upload files
-func (ftp *client) Upload(dirName, fileName string, buf []byte) error {
+func (ftp *Client) Upload(dirName, fileName string, buf []byte) error {
 	//the directory name can not start with "/"
 	ftp.MakeDir(dirName)
 	//select the current ftp directory
@@ -137,7 +295,7 @@ func (ftp *client) Upload(dirName, fileName string, buf []byte) error {
 
 // Names if the current directory exists to return a map
 // key is the subdirectory name, value is subdirectory under all file names
-func (ftp *client) Names(dirName string) (map[string][]string, error) {
+func (ftp *Client) Names(dirName string) (map[string][]string, error) {
 	dir := make(map[string][]string)
 	//get the file list
 	list, err := ftp.List(dirName)
@@ -164,12 +322,12 @@ func (ftp *client) Names(dirName string) (map[string][]string, error) {
 }
 
 // NameList issues an NLST FTP command.
-func (ftp *client) NameList(path string) (entries []string, err error) {
+func (ftp *Client) NameList(path string) (entries []string, err error) {
 	conn, err := ftp.cmdDataConnFrom(0, "NLST %s", path)
 	if err != nil {
 		return
 	}
-	r := &response{conn, ftp}
+	r := ftp.newResponse(conn)
 	defer r.Close()
 
 	scanner := bufio.NewScanner(r)
@@ -181,7 +339,42 @@ func (ftp *client) NameList(path string) (entries []string, err error) {
 }
 
 // List issues a LIST FTP command.
-func (ftp *client) List(path string) (entries []*Entry, err error) {
+func (ftp *Client) List(path string) (entries []*Entry, err error) {
+	if ftp.listCache != nil {
+		if entries, ok := ftp.listCache.get(path); ok {
+			return entries, nil
+		}
+	}
+	err = ftp.ListCallback(path, func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err == nil && !ftp.mlst && ftp.preciseTimes > 0 {
+		err = ftp.setPreciseTimes(path, entries)
+	}
+	if err == nil && ftp.listCache != nil {
+		ftp.listCache.put(path, entries)
+	}
+	return entries, err
+}
+
+// ListCallback is like List, but passes the entries to fn as they are
+// received instead of returning them all at once, so that the entries of a
+// long listing are not lost when the connection drops midway. The listing
+// stops when fn returns an error, which ListCallback returns.
+//
+// The lines which do not describe entries, such as the "total" header of ls
+// or the informational lines some servers prepend, are skipped.
+func (ftp *Client) ListCallback(path string, fn func(*Entry) error) error {
+	return ftp.listCallback(context.Background(), path, fn)
+}
+
+// listCallback implements ListCallback and ListContext, aborting the listing
+// once ctx is done.
+func (ftp *Client) listCallback(ctx context.Context, path string, fn func(*Entry) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	var cmd string
 	var parseFunc func(string) (*Entry, error)
 
@@ -190,29 +383,223 @@ func (ftp *client) List(path string) (entries []*Entry, err error) {
 		parseFunc = parseRFC3659ListLine
 	} else {
 		cmd = "LIST"
+		if ftp.listAll {
+			cmd = "LIST -a"
+		}
 		parseFunc = parseListLine
 	}
-	conn, err := ftp.cmdDataConnFrom(0, "%s %s", cmd, path)
+	var conn net.Conn
+	err := ftp.withContext(ctx, func() (err error) {
+		conn, err = ftp.cmdDataConnFrom(0, cmd+" %s", path)
+		return err
+	})
+	if emptyListing(err) {
+		return nil
+	}
 	if err != nil {
-		return
+		return err
 	}
-	r := &response{conn, ftp}
+	r := ftp.newResponse(conn)
 	defer r.Close()
+	defer watchContext(ctx, conn)()
 
 	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
+		if ctx.Err() != nil {
+			break
+		}
 		entry, err := parseFunc(scanner.Text())
-		if err == nil {
-			entries = append(entries, entry)
+		if err != nil {
+			continue
+		}
+		if !ftp.dirEntries && (entry.Type == EntryTypeCurrent || entry.Type == EntryTypeParent) {
+			continue
+		}
+		if err = fn(entry); err != nil {
+			return err
 		}
 	}
-	return entries, scanner.Err()
+	err = scanner.Err()
+	if ctxErr := contextErr(ctx, err); ctxErr != nil {
+		if r.abort() != nil {
+			ftp.suspect = true
+		}
+		return ctxErr
+	}
+	if err != nil {
+		return err
+	}
+	return ftp.withContext(ctx, r.Close)
+}
+
+// emptyListingReplies are the messages of the 450 and 550 replies some
+// servers make to list an empty directory, instead of an empty listing.
+var emptyListingReplies = []string{"no files", "no entries", "empty"}
+
+// emptyListing reports whether err is the reply of a server to the listing
+// of an empty directory, such as "550 No files found", rather than an error.
+func emptyListing(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || (protoErr.Code != StatusFileActionIgnored && protoErr.Code != StatusFileUnavailable) {
+		return false
+	}
+	msg := strings.ToLower(protoErr.Msg)
+	for _, reply := range emptyListingReplies {
+		if strings.Contains(msg, reply) {
+			return true
+		}
+	}
+	return false
+}
+
+// IncludeDirEntries makes List return the entries describing the listed
+// directory and its parent (EntryTypeCurrent and EntryTypeParent), which are
+// skipped by default.
+func (ftp *Client) IncludeDirEntries(include bool) {
+	ftp.dirEntries = include
+}
+
+// SetPreciseListTimes makes List issue a MDTM FTP command for each file
+// listed by LIST, whose times lack the seconds, and the year for the files
+// of the last months, to get their precise modification times. The MLSD
+// listings have precise times already.
+//
+// It costs a round trip per file: the MDTM commands are pipelined, window
+// commands being sent before waiting for their replies, which mostly hides
+// the latency of the server. A window of 0 disables the precise times, which
+// is the default.
+func (ftp *Client) SetPreciseListTimes(window int) {
+	ftp.preciseTimes = window
+}
+
+// setPreciseTimes sets the times of the files listed in dir from the replies
+// to pipelined MDTM commands. The files whose MDTM command fails keep their
+// time from the listing.
+func (ftp *Client) setPreciseTimes(dir string, entries []*Entry) error {
+	var files []*Entry
+	for _, entry := range entries {
+		if entry.Type == EntryTypeFile {
+			files = append(files, entry)
+		}
+	}
+	sent := 0
+	for read := range files {
+		for ; sent < len(files) && sent-read < ftp.preciseTimes; sent++ {
+			if _, err := ftp.conn.Cmd("MDTM %s", path.Join(dir, files[sent].Name)); err != nil {
+				return err
+			}
+			ftp.stats.sent()
+		}
+		code, msg, err := ftp.conn.ReadResponse(-1)
+		if err != nil {
+			return err
+		}
+		if code != StatusFile {
+			continue
+		}
+		if t, err := parseMdtm(msg); err == nil {
+			files[read].Time = t
+		}
+	}
+	return nil
+}
+
+// SetListAll makes List issue LIST -a FTP commands, so that the Unix servers
+// include the hidden files, whose names start with a dot. The MLSD listings
+// include them anyway.
+//
+// Beware that some servers do not take -a for a flag but for the name of the
+// file to list, and then return an empty listing or an error.
+func (ftp *Client) SetListAll(all bool) {
+	ftp.listAll = all
+}
+
+// ListDirs issues a LIST FTP command and only returns the directories,
+// without the "." and ".." entries.
+func (ftp *Client) ListDirs(path string) ([]*Entry, error) {
+	entries, err := ftp.List(path)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []*Entry
+	for _, entry := range entries {
+		if entry.Type != EntryTypeFolder || entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		dirs = append(dirs, entry)
+	}
+	return dirs, nil
+}
+
+// ListPaged lists the directory at path a page of at most pageSize entries at
+// a time, starting at cursor, which is empty for the first page and then the
+// nextCursor returned by the previous call. The listing is complete when
+// nextCursor is empty.
+//
+// Paged listings are not standardized, and no server extension is supported
+// yet: the whole listing is returned by the first call, with an empty
+// nextCursor.
+func (ftp *Client) ListPaged(path string, pageSize int, cursor string) (entries []*Entry, nextCursor string, err error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("Invalid page size: %d", pageSize)
+	}
+	if cursor != "" {
+		return nil, "", fmt.Errorf("Invalid cursor: %s", cursor)
+	}
+	entries, err = ftp.List(path)
+	return entries, "", err
+}
+
+// StatViaList issues a LIST FTP command on the file at path and returns its
+// entry. It is meant for the servers lacking MLST, SIZE and MDTM, and fails
+// unless exactly one line of the listing can be parsed.
+func (ftp *Client) StatViaList(path string) (*Entry, error) {
+	conn, err := ftp.cmdDataConnFrom(0, "LIST %s", path)
+	if err != nil {
+		return nil, err
+	}
+	r := ftp.newResponse(conn)
+	defer r.Close()
+
+	var entries []*Entry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		entry, err := parseListLine(scanner.Text())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err = r.Close(); err != nil {
+		return nil, err
+	}
+
+	switch len(entries) {
+	case 0:
+		return nil, errors.New("No entry listed for " + path)
+	case 1:
+		return entries[0], nil
+	default:
+		return nil, fmt.Errorf("%d entries listed for %s, expected one", len(entries), path)
+	}
+}
+
+// ForceMLSD overrides the detection of the MLSD support, which relies on the
+// MLST feature advertised by the server. When force is true, List issues MLSD
+// commands even if the server did not advertise it; when false, List falls
+// back to LIST.
+func (ftp *Client) ForceMLSD(force bool) {
+	ftp.mlst = force
 }
 
 // ChangeDir issues a CWD FTP command, which changes the current directory to
 // the specified path.
-func (ftp *client) ChangeDir(path string) error {
+func (ftp *Client) ChangeDir(path string) error {
+	ftp.InvalidateListCache(".")
 	_, _, err := ftp.cmd(StatusRequestedFileActionOK, "CWD %s", path)
 	return err
 }
@@ -220,29 +607,78 @@ func (ftp *client) ChangeDir(path string) error {
 // ChangeDirToParent issues a CDUP FTP command, which changes the current
 // directory to the parent directory.  This is similar to a call to ChangeDir
 // with a path set to "..".
-func (ftp *client) ChangeDirToParent() error {
+func (ftp *Client) ChangeDirToParent() error {
+	ftp.InvalidateListCache(".")
 	_, _, err := ftp.cmd(StatusRequestedFileActionOK, "CDUP")
 	return err
 }
 
 // CurrentDir issues a PWD FTP command, which Returns the path of the current
 // directory.
-func (ftp *client) CurrentDir() (string, error) {
+func (ftp *Client) CurrentDir() (string, error) {
 	_, msg, err := ftp.cmd(StatusPathCreated, "PWD")
 	if err != nil {
 		return "", err
 	}
-	start := strings.Index(msg, "\"")
-	end := strings.LastIndex(msg, "\"")
-
-	if start == -1 || end == -1 {
+	dir, ok := parseQuotedPath(msg)
+	if !ok {
 		return "", errors.New("Unsuported PWD response format")
 	}
-	return msg[start+1 : end], nil
+	return dir, nil
+}
+
+// SetWorkingDir changes the current directory to the absolute path absPath,
+// and checks with a PWD FTP command that the server landed in that directory.
+// An error is returned when it did not, which happens with some path
+// normalization or chroot quirks. In a chroot jail, absPath is relative to
+// the root of the jail, see IsChrooted.
+func (ftp *Client) SetWorkingDir(absPath string) error {
+	if !strings.HasPrefix(absPath, "/") {
+		return fmt.Errorf("Not an absolute path: %s", absPath)
+	}
+	if err := ftp.ChangeDir(absPath); err != nil {
+		return err
+	}
+	dir, err := ftp.CurrentDir()
+	if err != nil {
+		return err
+	}
+	if path.Clean(dir) != path.Clean(absPath) {
+		return fmt.Errorf("Changed to directory %s instead of %s", dir, absPath)
+	}
+	return nil
+}
+
+// IsChrooted guesses whether the user is confined in a chroot jail, in which
+// case the absolute paths seen on the server are relative to the root of the
+// jail rather than to the real root of the file system.
+//
+// It is a heuristic: the user is deemed chrooted when the initial directory
+// reported by PWD is the root, or when it cannot be changed to, which happens
+// with the servers reporting the real path of a directory outside the jail.
+// A server hiding its jail entirely cannot be detected. It should be called
+// right after Login, as it relies on the current directory being the home
+// directory of the user.
+func (ftp *Client) IsChrooted() (bool, error) {
+	home, err := ftp.CurrentDir()
+	if err != nil {
+		return false, err
+	}
+	if path.Clean(home) == "/" {
+		return true, nil
+	}
+	_, _, err = ftp.cmd(StatusRequestedFileActionOK, "CWD %s", home)
+	if err != nil {
+		if fileUnavailable(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
 }
 
 // FileSize issues a SIZE FTP command, which Returns the size of the file
-func (ftp *client) FileSize(path string) (int64, error) {
+func (ftp *Client) FileSize(path string) (int64, error) {
 	_, msg, err := ftp.cmd(StatusFile, "SIZE %s", path)
 	if err != nil {
 		return 0, err
@@ -250,11 +686,202 @@ func (ftp *client) FileSize(path string) (int64, error) {
 	return strconv.ParseInt(msg, 10, 64)
 }
 
+// FreeSpace returns the number of bytes available on the filesystem holding
+// path. It issues an AVBL FTP command, and falls back to parsing the output
+// of a SITE DF FTP command. ErrUnsupported is returned when the server
+// supports neither.
+func (ftp *Client) FreeSpace(path string) (int64, error) {
+	avail, err := ftp.avbl(path)
+	if err == nil {
+		return avail, nil
+	}
+	if unsupported(err) != ErrUnsupported {
+		return 0, err
+	}
+	code, msg, err := ftp.cmd(-1, "SITE DF")
+	if err != nil {
+		return 0, err
+	}
+	if code/100 != 2 {
+		return 0, unsupported(&textproto.Error{Code: code, Msg: msg})
+	}
+	return parseDf(msg)
+}
+
+// Available issues an AVBL FTP command, which returns the number of bytes
+// available on the filesystem holding path. ErrUnsupported is returned when
+// the server does not advertise AVBL, see FreeSpace for a fallback.
+func (ftp *Client) Available(path string) (int64, error) {
+	if _, ok := ftp.features["AVBL"]; !ok {
+		return 0, ErrUnsupported
+	}
+	avail, err := ftp.avbl(path)
+	return avail, unsupported(err)
+}
+
+// avbl issues an AVBL FTP command.
+func (ftp *Client) avbl(path string) (int64, error) {
+	_, msg, err := ftp.cmd(StatusFile, "AVBL %s", path)
+	if err != nil {
+		return 0, err
+	}
+	return parseLeadingInt(msg)
+}
+
+// StatRaw issues a MLST FTP command and returns the facts of the file, such
+// as "size", "modify" or server specific ones, without interpreting them.
+// The names of the facts are in lower case.
+func (ftp *Client) StatRaw(path string) (map[string]string, string, error) {
+	line, err := ftp.mlstLine(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return parseFacts(line)
+}
+
+// mlstLine issues a MLST FTP command and returns the line of the reply
+// holding the facts of the file.
+func (ftp *Client) mlstLine(path string) (string, error) {
+	_, msg, err := ftp.cmd(StatusRequestedFileActionOK, "MLST %s", path)
+	if err != nil {
+		return "", err
+	}
+	// The facts are on the only line starting with a space
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(line, " ") {
+			return strings.TrimSpace(line), nil
+		}
+	}
+	return "", errors.New("Unsupported MLST response format")
+}
+
+// PathType returns the type of the entry at path, and false with a nil error
+// when it does not exist. It issues a single MLST FTP command when the server
+// supports it. Otherwise a SIZE FTP command tells a file, and a directory is
+// recognized by changing to it then back to the current directory.
+func (ftp *Client) PathType(path string) (EntryType, bool, error) {
+	if ftp.mlst {
+		facts, _, err := ftp.StatRaw(path)
+		if err != nil {
+			if fileUnavailable(err) {
+				return 0, false, nil
+			}
+			return 0, false, err
+		}
+		switch kind := strings.ToLower(facts["type"]); {
+		case kind == "dir" || kind == "cdir" || kind == "pdir":
+			return EntryTypeFolder, true, nil
+		case strings.HasPrefix(kind, "os.unix=slink"):
+			return EntryTypeLink, true, nil
+		default:
+			return EntryTypeFile, true, nil
+		}
+	}
+
+	if _, err := ftp.FileSize(path); err == nil {
+		return EntryTypeFile, true, nil
+	}
+	dir, err := ftp.CurrentDir()
+	if err != nil {
+		return 0, false, err
+	}
+	if _, _, err = ftp.cmd(StatusRequestedFileActionOK, "CWD %s", path); err != nil {
+		if fileUnavailable(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if _, _, err = ftp.cmd(StatusRequestedFileActionOK, "CWD %s", dir); err != nil {
+		return 0, false, err
+	}
+	return EntryTypeFolder, true, nil
+}
+
+// fileUnavailable reports whether err is a 550 reply, such as for a file
+// which does not exist.
+func fileUnavailable(err error) bool {
+	var e *textproto.Error
+	return errors.As(err, &e) && e.Code == StatusFileUnavailable
+}
+
+// ServerTime returns the current time of the remote FTP server, which helps
+// detecting a clock skew. It tries a SITE TIME FTP command, and falls back to
+// creating an empty temporary file in the current directory and reading its
+// modification time with MDTM. The temporary file is always removed.
+func (ftp *Client) ServerTime() (time.Time, error) {
+	code, msg, err := ftp.cmd(-1, "SITE TIME")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if code/100 == 2 {
+		for _, field := range strings.Fields(msg) {
+			if t, err := parseMdtm(field); err == nil {
+				return t, nil
+			}
+		}
+	}
+
+	name := fmt.Sprintf(".ftp-servertime-%d", time.Now().UnixNano())
+	defer ftp.Remove(name)
+	if err = ftp.Stor(name, bytes.NewReader(nil)); err != nil {
+		return time.Time{}, err
+	}
+
+	return ftp.mdtm(name)
+}
+
+// ModTime issues a MDTM FTP command, which returns the modification time of
+// the file at path in UTC, to the second or better. ErrUnsupported is
+// returned when the server does not advertise MDTM.
+func (ftp *Client) ModTime(path string) (time.Time, error) {
+	if _, ok := ftp.features["MDTM"]; !ok {
+		return time.Time{}, ErrUnsupported
+	}
+	t, err := ftp.mdtm(path)
+	return t, unsupported(err)
+}
+
+// SetModTime sets the modification time of the file at path, with a MFMT
+// FTP command when the server advertises it, a SITE UTIME FTP command
+// otherwise. ErrUnsupported is returned, wrapped, when the server supports
+// neither.
+func (ftp *Client) SetModTime(path string, t time.Time) error {
+	stamp := t.UTC().Format("20060102150405")
+	if _, ok := ftp.features["MFMT"]; ok {
+		_, _, err := ftp.cmd(StatusFile, "MFMT %s %s", stamp, path)
+		return unsupported(err)
+	}
+	// the form of Pure-FTPd and ProFTPD, setting the access, modification
+	// and creation times
+	code, msg, err := ftp.cmd(-1, "SITE UTIME %s %s %s %s UTC", path, stamp, stamp, stamp)
+	if err != nil {
+		return err
+	}
+	if code/100 == 2 {
+		return nil
+	}
+	protoErr := &textproto.Error{Code: code, Msg: msg}
+	if unsupported(protoErr) == ErrUnsupported {
+		return fmt.Errorf("%w: the server implements neither MFMT nor SITE UTIME", ErrUnsupported)
+	}
+	return protoErr
+}
+
+// mdtm issues a MDTM FTP command, which returns the modification time of
+// the file.
+func (ftp *Client) mdtm(path string) (time.Time, error) {
+	_, msg, err := ftp.cmd(StatusFile, "MDTM %s", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseMdtm(msg)
+}
+
 // Retr issues a RETR FTP command to fetch the specified file from the remote
 // FTP server.
 //
 // The returned ReadCloser must be closed to cleanup the FTP data connection.
-func (ftp *client) Retr(path string) (io.ReadCloser, error) {
+func (ftp *Client) Retr(path string) (io.ReadCloser, error) {
 	return ftp.RetrFrom(path, 0)
 }
 
@@ -262,19 +889,74 @@ func (ftp *client) Retr(path string) (io.ReadCloser, error) {
 // FTP server, the server will not send the offset first bytes of the file.
 //
 // The returned ReadCloser must be closed to cleanup the FTP data connection.
-func (ftp *client) RetrFrom(path string, offset uint64) (io.ReadCloser, error) {
+func (ftp *Client) RetrFrom(path string, offset uint64) (io.ReadCloser, error) {
+	ftp.event(Event{Type: EventTransferStart, Path: path, Size: -1})
+	size := int64(-1)
+	if ftp.verifySize {
+		if fileSize, err := ftp.FileSize(path); err == nil {
+			size = fileSize - int64(offset)
+		}
+	}
 	conn, err := ftp.cmdDataConnFrom(offset, "RETR %s", path)
+	if err != nil {
+		return nil, ftp.failed("retr", err)
+	}
+	r := ftp.newResponse(conn)
+	r.size = size
+	r.keepAlive = ftp.startKeepAlive()
+	r.path = path
+	r.start = time.Now()
+	return r, nil
+}
+
+// RetrTo retrieves the file at path into w, and returns the number of bytes
+// copied. Unlike with Retr, the data connection is always closed.
+func (ftp *Client) RetrTo(path string, w io.Writer) (int64, error) {
+	r, err := ftp.Retr(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ftp.copy(w, r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// RetrRetry is like Retr, but when the transfer breaks, the reader resumes it
+// transparently from the bytes already read with a REST FTP command, up to
+// attempts times over the whole transfer.
+//
+// As for StorRetry, the permanent errors of the server (5xx replies) fail at
+// once, and the client reconnects and logs in again after any other error
+// than a reply of the server, such as a dropped control connection.
+func (ftp *Client) RetrRetry(path string, attempts int) (io.ReadCloser, error) {
+	r, err := ftp.Retr(path)
+	if err != nil {
+		return nil, err
+	}
+	return &retryReader{c: ftp, path: path, r: r, attempts: attempts}, nil
+}
+
+// RetrTransform is like Retr, but the data is read through the reader
+// returned by transform, such as a decompressing one, which is called with
+// the reader of the data connection.
+//
+// Closing the returned ReadCloser closes the transforming reader when it is
+// an io.Closer, then the data connection.
+func (ftp *Client) RetrTransform(path string, transform func(io.Reader) io.Reader) (io.ReadCloser, error) {
+	r, err := ftp.Retr(path)
 	if err != nil {
 		return nil, err
 	}
-	return &response{conn, ftp}, nil
+	return &transformReader{Reader: transform(r), r: r}, nil
 }
 
 // Stor issues a STOR FTP command to store a file to the remote FTP server.
 // Stor creates the specified file with the content of the io.Reader.
 //
 // Hint: io.Pipe() can be used if an io.Writer is required.
-func (ftp *client) Stor(path string, r io.Reader) error {
+func (ftp *Client) Stor(path string, r io.Reader) error {
 	return ftp.StorFrom(path, r, 0)
 }
 
@@ -282,23 +964,295 @@ func (ftp *client) Stor(path string, r io.Reader) error {
 // Stor creates the specified file with the content of the io.Reader, writing
 // on the server will start at the given file offset.
 //
+// When the server rejects the transfer, even after all the data was sent,
+// the error is the *textproto.Error of its final reply, whose Code tells a
+// full quota (StatusExceededStorage) from an aborted transfer
+// (StatusTransfertAborted).
+//
 // Hint: io.Pipe() can be used if an io.Writer is required.
-func (ftp *client) StorFrom(path string, r io.Reader, offset uint64) error {
-	conn, err := ftp.cmdDataConnFrom(offset, "STOR %s", path)
+func (ftp *Client) StorFrom(path string, r io.Reader, offset uint64) error {
+	_, err := ftp.StorN(path, r, offset)
+	return err
+}
+
+// StorN is like StorFrom, but also returns the number of bytes sent to the
+// server, including when the transfer fails.
+func (ftp *Client) StorN(path string, r io.Reader, offset uint64) (int64, error) {
+	if err := ftp.allocate(r); err != nil {
+		return 0, err
+	}
+	return ftp.storCmd(context.Background(), "STOR", path, r, offset)
+}
+
+// Append issues an APPE FTP command to append the content of r to the file
+// at path on the remote FTP server, which is created if it does not exist.
+// Unlike StorFrom with an offset, the existing content is never truncated.
+func (ftp *Client) Append(path string, r io.Reader) error {
+	_, err := ftp.storCmd(context.Background(), "APPE", path, r, 0)
+	return err
+}
+
+// allocate issues an ALLO FTP command reserving the size of the upload of r,
+// when the server advertises ALLO and r tells its size with a Len or Size
+// method, like bytes.Reader. Only the replies refusing the storage, such as
+// a full quota, are errors.
+func (ftp *Client) allocate(r io.Reader) error {
+	if _, ok := ftp.features["ALLO"]; !ok {
+		return nil
+	}
+	var size int64
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		size = int64(r.Len())
+	case interface{ Size() int64 }:
+		size = r.Size()
+	default:
+		return nil
+	}
+	code, msg, err := ftp.cmd(-1, "ALLO %d", size)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(conn, r)
-	conn.Close()
+	if code == Status452 || code == StatusExceededStorage {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+	return nil
+}
+
+// StorAtomic uploads the content of r to the file at path, like Stor, but
+// through a temporary file next to it, renamed to path once the transfer is
+// complete: the readers of path never see a partial file. The temporary file
+// is removed when the upload fails.
+func (ftp *Client) StorAtomic(path string, r io.Reader) error {
+	tmp, err := tempName(path)
 	if err != nil {
 		return err
 	}
-	_, _, err = ftp.conn.ReadResponse(StatusClosingDataConnection)
+	if err = ftp.Stor(tmp, r); err == nil {
+		err = ftp.Rename(tmp, path)
+	}
+	if err != nil {
+		ftp.Remove(tmp)
+	}
+	return err
+}
+
+// tempName returns a unique name for a temporary file next to the file at
+// name, such as "dir/.file.txt.3f2a9c81d0e4b756.tmp".
+func tempName(name string) (string, error) {
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	dir, file := path.Split(name)
+	return dir + "." + file + "." + hex.EncodeToString(random[:]) + ".tmp", nil
+}
+
+// StorRetry uploads the content returned by open to the file at path, like
+// Stor, trying again up to attempts times when the transfer fails. open is
+// called for each attempt, and the reader it returns is closed afterwards.
+//
+// The permanent errors of the server (5xx replies) fail at once. After any
+// other error than a reply of the server, such as a dropped connection, the
+// client reconnects and logs in again before the next attempt.
+func (ftp *Client) StorRetry(path string, open func() (io.ReadCloser, error), attempts int) error {
+	var err error
+	for i := 0; i < attempts || i == 0; i++ {
+		var protoErr *textproto.Error
+		if err != nil && !errors.As(err, &protoErr) {
+			if err = ftp.reconnect(); err != nil {
+				continue
+			}
+			if err = ftp.restoreSession(ftp.User, ftp.Pass); err != nil {
+				continue
+			}
+		}
+		r, openErr := open()
+		if openErr != nil {
+			return openErr
+		}
+		_, err = ftp.storCmd(context.Background(), "STOR", path, r, 0)
+		r.Close()
+		// permanent replies and paths rejected before being sent are final
+		if err == nil || errors.Is(err, ErrPathTooLong) || errors.As(err, &protoErr) && protoErr.Code >= 500 {
+			return err
+		}
+	}
 	return err
 }
 
+// StorResume resumes an interrupted upload without relying on REST: the size
+// of the partial remote file is requested with SIZE, r is seeked to that
+// offset and the remaining bytes are appended with an APPE FTP command.
+// The size of the remote file is checked once the transfer is complete.
+func (ftp *Client) StorResume(path string, r io.ReadSeeker) error {
+	offset, err := ftp.uploadedSize(path)
+	if err != nil {
+		return err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		return fmt.Errorf("Remote file is larger than the local one: %d > %d bytes", offset, size)
+	}
+	if _, err = r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err = ftp.storCmd(context.Background(), "APPE", path, r, 0); err != nil {
+		return err
+	}
+	remoteSize, err := ftp.FileSize(path)
+	if err != nil {
+		return err
+	}
+	if remoteSize != size {
+		return fmt.Errorf("Resumed upload size mismatch: remote %d bytes, local %d bytes", remoteSize, size)
+	}
+	return nil
+}
+
+// StorChunked uploads the content of r in chunks of chunkSize bytes: the
+// first one is sent with STOR and the next ones are appended with APPE, the
+// size of the remote file being checked after each of them. A failure thus
+// only loses the current chunk.
+//
+// When the remote file already exists, the upload resumes after its last
+// byte: r must then provide the whole content again, the bytes already
+// uploaded are skipped.
+func (ftp *Client) StorChunked(path string, r io.Reader, chunkSize int64) error {
+	if chunkSize <= 0 {
+		return errors.New("Invalid chunk size")
+	}
+	offset, err := ftp.uploadedSize(path)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		if _, err = io.CopyN(ioutil.Discard, r, offset); err != nil {
+			return err
+		}
+	}
+	br := bufio.NewReader(r)
+
+	for {
+		command := "APPE"
+		if offset == 0 {
+			command = "STOR"
+		}
+		n, err := ftp.storCmd(context.Background(), command, path, io.LimitReader(br, chunkSize), 0)
+		if err != nil {
+			return err
+		}
+		offset += n
+
+		size, err := ftp.FileSize(path)
+		if err != nil {
+			return err
+		}
+		if size != offset {
+			return fmt.Errorf("Chunk upload size mismatch: remote %d bytes, expected %d bytes", size, offset)
+		}
+		if _, err = br.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// uploadedSize returns the size of a remote file, 0 if it does not exist.
+func (ftp *Client) uploadedSize(path string) (int64, error) {
+	size, err := ftp.FileSize(path)
+	if fileUnavailable(err) {
+		return 0, nil
+	}
+	return size, err
+}
+
+// storCmd sends the content of r over a new data connection opened for the
+// given command, and waits for the end of the transfer.
+func (ftp *Client) storCmd(ctx context.Context, command, path string, r io.Reader, offset uint64) (int64, error) {
+	ftp.event(Event{Type: EventTransferStart, Path: path, Size: -1})
+	start := time.Now()
+	ftp.invalidateParent(path)
+
+	var conn net.Conn
+	err := ftp.withContext(ctx, func() (err error) {
+		conn, err = ftp.cmdDataConnFrom(offset, command+" %s", path)
+		return err
+	})
+	if err != nil {
+		return 0, ftp.failed("stor", err)
+	}
+	keepAlive := ftp.startKeepAlive()
+	stop := watchContext(ctx, conn)
+	n, err := ftp.copy(conn, r)
+	atomic.AddInt64(&ftp.stats.uploaded, n)
+	if e, ok := conn.(endOfFileWriter); ok && err == nil {
+		err = e.endOfFile()
+	}
+	stop()
+	conn.Close()
+	// the final reply tells why the server failed the transfer, which may
+	// also be the cause of a failed write
+	response := func() error {
+		return ftp.transferResponse(keepAlive.Stop())
+	}
+	var respErr error
+	if ctx.Err() != nil {
+		// the data connection closed by ctx makes the server reply at once
+		respErr = response()
+	} else {
+		respErr = ftp.withContext(ctx, response)
+	}
+	if respErr != nil {
+		err = respErr
+	}
+	if err != nil {
+		if ctxErr := contextErr(ctx, err); ctxErr != nil {
+			err = ctxErr
+		}
+	}
+	if err == nil && ftp.postStorVerify && command == "STOR" {
+		err = ftp.waitStored(path, int64(offset)+n)
+	}
+	if err != nil {
+		return n, ftp.failed("stor", err)
+	}
+	ftp.event(Event{Type: EventTransferComplete, Path: path, Bytes: n, Duration: time.Since(start)})
+	return n, ftp.applyDefaultMode(path, ftp.fileMode)
+}
+
+// waitStored polls the size of an uploaded file until it is size, see
+// SetPostStorVerify.
+func (ftp *Client) waitStored(path string, size int64) error {
+	deadline := time.Now().Add(postStorTimeout)
+	delay := postStorInterval
+	for {
+		stored, err := ftp.FileSize(path)
+		if err == nil && stored == size {
+			return nil
+		}
+		if err != nil && !fileUnavailable(err) {
+			if unsupported(err) == ErrUnsupported {
+				return nil
+			}
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s has %d bytes, expected %d", ErrUploadNotVisible, path, stored, size)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // Rename renames a file on the remote FTP server.
-func (ftp *client) Rename(from, to string) error {
+func (ftp *Client) Rename(from, to string) error {
+	ftp.invalidateParent(from)
+	ftp.invalidateParent(to)
 	_, _, err := ftp.cmd(StatusRequestFilePending, "RNFR %s", from)
 	if err != nil {
 		return err
@@ -308,23 +1262,237 @@ func (ftp *client) Rename(from, to string) error {
 	return err
 }
 
+// Symlink issues a SITE SYMLINK FTP command to create on the remote FTP
+// server a symbolic link named linkName pointing to target.
+// ErrUnsupported is returned when the server does not implement it.
+func (ftp *Client) Symlink(target, linkName string) error {
+	ftp.invalidateParent(linkName)
+	_, _, err := ftp.cmd(StatusCommandOK, "SITE SYMLINK %s %s", target, linkName)
+	return unsupported(err)
+}
+
+// Help issues a HELP FTP command, about the given command if any, and
+// returns the text of the reply without the reply codes.
+func (ftp *Client) Help(command ...string) (string, error) {
+	format := "HELP"
+	if len(command) > 0 && command[0] != "" {
+		format += " " + command[0]
+	}
+	code, msg, err := ftp.cmd(-1, "%s", format)
+	if err != nil {
+		return "", err
+	}
+	if code != StatusHelp && code != StatusSystem {
+		return "", unsupported(&textproto.Error{Code: code, Msg: msg})
+	}
+	return msg, nil
+}
+
+// SiteHelp issues a SITE HELP FTP command and returns the SITE subcommands
+// supported by the server, such as CHMOD or SYMLINK.
+func (ftp *Client) SiteHelp() ([]string, error) {
+	code, msg, err := ftp.cmd(-1, "SITE HELP")
+	if err != nil {
+		return nil, err
+	}
+	if code/100 != 2 {
+		return nil, unsupported(&textproto.Error{Code: code, Msg: msg})
+	}
+	return parseHelpCommands(msg), nil
+}
+
+// Chmod issues a SITE CHMOD FTP command to change the permissions of the file
+// at path. ErrUnsupported is returned when the server does not implement it.
+func (ftp *Client) Chmod(path string, mode os.FileMode) error {
+	_, _, err := ftp.cmd(StatusCommandOK, "SITE CHMOD %o %s", mode.Perm(), path)
+	return unsupported(err)
+}
+
+// SetDefaultMode sets the permissions given with SITE CHMOD FTP commands to
+// the files uploaded by Stor and its variants, and to the directories created
+// by MakeDir and MakeDirAll, 0 leaving the permissions chosen by the server.
+//
+// When the server does not implement SITE CHMOD, the permissions are left
+// alone: ErrUnsupported is reported once to the event handler, as an
+// EventError with the Op "chmod", and the upload or the creation of the
+// directory succeeds. The other SITE CHMOD errors are returned.
+func (ftp *Client) SetDefaultMode(fileMode, dirMode os.FileMode) {
+	ftp.fileMode = fileMode
+	ftp.dirMode = dirMode
+}
+
+// applyDefaultMode gives mode, set by SetDefaultMode, to the file at path.
+func (ftp *Client) applyDefaultMode(path string, mode os.FileMode) error {
+	if mode == 0 || ftp.chmodUnsupported {
+		return nil
+	}
+	err := ftp.Chmod(path, mode)
+	if err == ErrUnsupported {
+		ftp.chmodUnsupported = true
+		ftp.failed("chmod", err)
+		return nil
+	}
+	return err
+}
+
 // Remove issues a DELE FTP command to delete the specified file from the
 // remote FTP server.
-func (ftp *client) Remove(path string) error {
+func (ftp *Client) Remove(path string) error {
+	ftp.invalidateParent(path)
 	_, _, err := ftp.cmd(StatusRequestedFileActionOK, "DELE %s", path)
 	return err
 }
 
 // MakeDir issues a MKD FTP command to create the specified directory on the
 // remote FTP server.
-func (ftp *client) MakeDir(path string) error {
-	_, _, err := ftp.cmd(StatusPathCreated, "MKD %s", path)
+func (ftp *Client) MakeDir(path string) error {
+	_, err := ftp.MakeDirPath(path)
 	return err
 }
 
+// MakeDirPath is like MakeDir, but returns the path of the created directory
+// as reported by the server, usually absolute, or path itself when the reply
+// does not contain it.
+func (ftp *Client) MakeDirPath(path string) (string, error) {
+	ftp.invalidateParent(path)
+	_, msg, err := ftp.cmd(StatusPathCreated, "MKD %s", path)
+	if err != nil {
+		return "", err
+	}
+	created, ok := parseQuotedPath(msg)
+	if !ok {
+		created = path
+	}
+	return created, ftp.applyDefaultMode(path, ftp.dirMode)
+}
+
+// MakeDirAll creates the directory dir along with any missing parent, like
+// os.MkdirAll. The directories which already exist are left untouched.
+func (ftp *Client) MakeDirAll(dir string) error {
+	dir = path.Clean(dir)
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	prefix := ""
+	if strings.HasPrefix(dir, "/") {
+		prefix = "/"
+	}
+	var err error
+	for _, name := range strings.Split(strings.TrimPrefix(dir, "/"), "/") {
+		prefix = path.Join(prefix, name)
+		err = ftp.MakeDir(prefix)
+		// the other replies may mean that the directory already exists
+		var protoErr *textproto.Error
+		if errors.Is(err, ErrPathTooLong) || err != nil && !errors.As(err, &protoErr) {
+			return err
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	// MKD failed on dir, which must then already exist
+	cwd, pwdErr := ftp.CurrentDir()
+	if pwdErr != nil {
+		return pwdErr
+	}
+	if ftp.ChangeDir(dir) != nil {
+		return err
+	}
+	return ftp.ChangeDir(cwd)
+}
+
+// WriteFile uploads data to the file name, like ioutil.WriteFile. With mkdirs,
+// the missing parent directories are created first.
+func (ftp *Client) WriteFile(name string, data []byte, mkdirs bool) error {
+	if mkdirs {
+		if err := ftp.MakeDirAll(path.Dir(name)); err != nil {
+			return err
+		}
+	}
+	return ftp.Stor(name, bytes.NewReader(data))
+}
+
+// Archive moves the file srcPath into the subdirectory of destRoot named
+// after the date of t, destRoot/2006/01/02, which is created if needed, and
+// returns the new path of the file.
+//
+// When the server refuses to rename the file across directories, replying
+// to RNTO with 502, 504 or 553, it is downloaded to a temporary file,
+// uploaded to its new path and then deleted. The other errors are returned.
+func (ftp *Client) Archive(srcPath, destRoot string, t time.Time) (string, error) {
+	dir := path.Join(destRoot, t.Format("2006/01/02"))
+	if err := ftp.MakeDirAll(dir); err != nil {
+		return "", err
+	}
+	dest := path.Join(dir, path.Base(srcPath))
+
+	ftp.invalidateParent(srcPath)
+	ftp.invalidateParent(dest)
+	if _, _, err := ftp.cmd(StatusRequestFilePending, "RNFR %s", srcPath); err != nil {
+		return "", err
+	}
+	_, _, err := ftp.cmd(StatusRequestedFileActionOK, "RNTO %s", dest)
+	if !crossRenameRefused(err) {
+		if err != nil {
+			return "", err
+		}
+		return dest, nil
+	}
+	if err = ftp.copyFile(srcPath, dest); err != nil {
+		return "", err
+	}
+	if err = ftp.Remove(srcPath); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// crossRenameRefused reports whether err is a reply to RNTO meaning that the
+// server does not rename files across directories.
+func crossRenameRefused(err error) bool {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return false
+	}
+	switch protoErr.Code {
+	case StatusNotImplemented, StatusNotImplementedParameter, StatusBadFileName:
+		return true
+	}
+	return false
+}
+
+// copyFile copies the file src to dest through a local temporary file, as
+// the control connection can not carry two transfers at once.
+func (ftp *Client) copyFile(src, dest string) error {
+	tmp, err := ioutil.TempFile("", "ftp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	r, err := ftp.Retr(src)
+	if err != nil {
+		return err
+	}
+	_, err = ftp.copy(tmp, r)
+	if err2 := r.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return ftp.Stor(dest, tmp)
+}
+
 // RemoveDir issues a RMD FTP command to remove the specified directory from
 // the remote FTP server.
-func (ftp *client) RemoveDir(path string) error {
+func (ftp *Client) RemoveDir(path string) error {
+	ftp.invalidateParent(path)
 	_, _, err := ftp.cmd(StatusRequestedFileActionOK, "RMD %s", path)
 	return err
 }
@@ -332,7 +1500,46 @@ func (ftp *client) RemoveDir(path string) error {
 // NoOp issues a NOOP FTP command.
 // NOOP has no effects and is usually used to prevent the remote FTP server to
 // close the otherwise idle connection.
-func (ftp *client) NoOp() error {
+func (ftp *Client) NoOp() error {
 	_, _, err := ftp.cmd(StatusCommandOK, "NOOP")
 	return err
 }
+
+// RawCmd issues a command as is and returns the code and message of the
+// reply, whatever the code. It is meant for the commands this package does
+// not know about, which must not require a data connection.
+func (ftp *Client) RawCmd(format string, args ...interface{}) (int, string, error) {
+	return ftp.cmd(-1, format, args...)
+}
+
+// Result is the reply to a command issued by Batch.
+type Result struct {
+	Command string
+	Code    int
+	Message string
+}
+
+// Batch issues the commands one after the other with RawCmd, and returns the
+// replies received. A reply with a 4xx or 5xx code is an error: Batch returns
+// the first one, stopping there if stopOnError is true. A network error
+// always stops the batch.
+func (ftp *Client) Batch(stopOnError bool, cmds ...string) ([]Result, error) {
+	var results []Result
+	var firstErr error
+
+	for _, command := range cmds {
+		code, msg, err := ftp.RawCmd("%s", command)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, Result{Command: command, Code: code, Message: msg})
+
+		if code >= 400 && firstErr == nil {
+			firstErr = &textproto.Error{Code: code, Msg: msg}
+			if stopOnError {
+				break
+			}
+		}
+	}
+	return results, firstErr
+}
@@ -16,8 +16,16 @@ package ftp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/textproto"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -115,7 +123,7 @@ func testConn(t *testing.T, disableEPSV bool) {
 		t.Error(err)
 	}
 	if fileSize != 14 {
-		t.Errorf("file size %q, expected %q", fileSize, 14)
+		t.Errorf("file size %d, expected %d", fileSize, 14)
 	}
 
 	data = bytes.NewBufferString("")
@@ -129,7 +137,7 @@ func testConn(t *testing.T, disableEPSV bool) {
 		t.Error(err)
 	}
 	if fileSize != 0 {
-		t.Errorf("file size %q, expected %q", fileSize, 0)
+		t.Errorf("file size %d, expected %d", fileSize, 0)
 	}
 
 	_, err = c.FileSize("not-found")
@@ -137,7 +145,7 @@ func testConn(t *testing.T, disableEPSV bool) {
 		t.Fatal("expected error, got nil")
 	}
 
-	err = c.Delete("tset")
+	err = c.Remove("tset")
 	if err != nil {
 		t.Error(err)
 	}
@@ -218,3 +226,2524 @@ func TestConnIPv6(t *testing.T) {
 
 	c.Close()
 }
+
+func TestConfigAddress(t *testing.T) {
+	tests := []struct {
+		cfg     Config
+		address string
+	}{
+		{Config{Addr: "ftp.example.com"}, "ftp.example.com:21"},
+		{Config{Addr: "ftp.example.com:2121"}, "ftp.example.com:2121"},
+		{Config{Addr: "ftp.example.com:21"}, "ftp.example.com:21"},
+		{Config{Addr: "ftp.example.com", Port: 2121}, "ftp.example.com:2121"},
+		{Config{Addr: "ftp.example.com:990", Port: 2121}, "ftp.example.com:990"},
+		{Config{Addr: "::1"}, "[::1]:21"},
+		{Config{Addr: "[::1]"}, "[::1]:21"},
+	}
+	for _, test := range tests {
+		if address := test.cfg.address(); address != test.address {
+			t.Errorf("address of %+v = %q, expected %q", test.cfg, address, test.address)
+		}
+	}
+}
+
+func TestNewClientCustomPort(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	// the mock listens on a random port, never 21
+	config, err := ioutil.TempFile("", "ftp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config.Name())
+	fmt.Fprintf(config, `{"ftpSrvOptions": {"url": %q, "user": "anonymous", "pwd": "anonymous"}}`, mock.Addr())
+	config.Close()
+
+	c, err := NewClient(config.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.addr != mock.Addr() {
+		t.Errorf("dialed %s, expected %s", c.addr, mock.Addr())
+	}
+}
+
+func TestNewClientOptions(t *testing.T) {
+	mock, _ := newFtpMockTLS(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+
+	config, err := ioutil.TempFile("", "ftp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config.Name())
+	fmt.Fprintf(config, `{"ftpSrvOptions": {"url": %q, "user": "anonymous", "pwd": "anonymous",
+		"tls": true, "skipVerify": true, "timeout": "3s", "passiveMode": "PASVOnly"}}`, mock.Addr())
+	config.Close()
+
+	c, err := NewClient(config.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.tlsConfig == nil || c.timeout != 3*time.Second || c.passiveMode != PASVOnly {
+		t.Errorf("options not applied: TLS %v, timeout %v, passive mode %d", c.tlsConfig != nil, c.timeout, c.passiveMode)
+	}
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if containsCommand(mock.Commands(), "EPSV") {
+		t.Errorf("EPSV sent in PASVOnly mode: %v", mock.Commands())
+	}
+
+	if _, err = (Config{Addr: mock.Addr(), PassiveMode: "Active"}).Dial(); err == nil {
+		t.Error("expected error for an unknown passive mode, got nil")
+	}
+
+	// without PassiveMode, the mode set by the options is kept
+	c2, err := (Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous"}).Dial(WithoutEPSV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if c2.passiveMode != PASVOnly {
+		t.Errorf("got passive mode %d, expected the one of WithoutEPSV", c2.passiveMode)
+	}
+}
+
+func TestForceMLSD(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/", "modify=20230102030405;perm=adfr;size=42;type=file; precise.txt")
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.ForceMLSD(true)
+	entries, err := c.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, expected 1", len(entries))
+	}
+	expected := time.Date(2023, time.January, 2, 3, 4, 5, 0, time.UTC)
+	if !entries[0].Time.Equal(expected) {
+		t.Errorf("entry time %v, expected %v", entries[0].Time, expected)
+	}
+	if commands := mock.Commands(); commands[len(commands)-1] != "MLSD /" {
+		t.Errorf("last command %q, expected MLSD", commands[len(commands)-1])
+	}
+
+	c.ForceMLSD(false)
+	if _, err = c.List("/"); err != nil {
+		t.Fatal(err)
+	}
+	if commands := mock.Commands(); commands[len(commands)-1] != "LIST /" {
+		t.Errorf("last command %q, expected LIST", commands[len(commands)-1])
+	}
+}
+
+func TestTransferStatus(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.Accept()
+		if err != nil {
+			s.Reply(StatusCanNotOpenDataConnection, err.Error())
+			return
+		}
+		defer conn.Close()
+		first := make([]byte, 7)
+		if _, err = io.ReadFull(conn, first); err != nil {
+			return
+		}
+		if line, _ := s.proto.ReadLine(); line == "STAT" {
+			s.Reply(StatusFile, "Status: 7 bytes received")
+		}
+		rest, _ := ioutil.ReadAll(conn)
+		s.m.SetFile(arg, append(first, rest...))
+		s.Reply(StatusClosingDataConnection, "Transfer complete")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.TransferStatus(); err == nil {
+		t.Error("expected an error without any transfer")
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Stor("file", pr)
+	}()
+	pw.Write([]byte(testData[:7]))
+	status, err := c.TransferStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "Status: 7 bytes received" {
+		t.Errorf("got status %q", status)
+	}
+	pw.Write([]byte(testData[7:]))
+	pw.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("file"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+}
+
+func TestStorAllocate(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "ALLO")
+	full := false
+	mock.Handle("ALLO", func(s *mockSession, arg string) {
+		if full {
+			s.Reply(StatusExceededStorage, "Quota exceeded")
+			return
+		}
+		s.Reply(StatusCommandOK, "ALLO command successful")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Stor("file", bytes.NewReader([]byte(testData))); err != nil {
+		t.Fatal(err)
+	}
+	if !containsCommand(mock.Commands(), fmt.Sprintf("ALLO %d", len(testData))) {
+		t.Errorf("expected ALLO with the size of the upload, got %v", mock.Commands())
+	}
+
+	// the upload is not even attempted when the storage is refused
+	full = true
+	sent := len(mock.Commands())
+	err = c.Stor("other", bytes.NewReader([]byte(testData)))
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusExceededStorage {
+		t.Errorf("got error %v, expected the reply to ALLO", err)
+	}
+	if commands := mock.Commands()[sent:]; len(commands) != 1 {
+		t.Errorf("got commands %v, expected ALLO alone", commands)
+	}
+}
+
+func TestStorPreliminaryReplies(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		data, ok := s.Receive()
+		if !ok {
+			return
+		}
+		s.m.SetFile(arg, data)
+		s.Reply(StatusAboutToSend, "Still writing to disk")
+		s.Reply(StatusClosingDataConnection, "Transfer complete")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Stor("file", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if dir, err := c.CurrentDir(); err != nil || dir != "/" {
+		t.Errorf("got directory %q, %v, the control connection is out of sync", dir, err)
+	}
+}
+
+func TestStorN(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n, err := c.StorN("file", bytes.NewBufferString(testData), 0)
+	if err != nil || n != int64(len(testData)) {
+		t.Errorf("StorN = %d, %v, expected %d bytes", n, err, len(testData))
+	}
+	n, err = c.StorN("file", bytes.NewBufferString(testData[4:]), 4)
+	if err != nil || n != int64(len(testData)-4) {
+		t.Errorf("StorN from 4 = %d, %v, expected %d bytes", n, err, len(testData)-4)
+	}
+	if data, _ := mock.File("file"); string(data) != testData {
+		t.Errorf("got %q, expected %q", data, testData)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("log", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Append("log", bytes.NewBufferString("more\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Append("new", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("log"); string(data) != testData+"more\n" {
+		t.Errorf("got %q, expected the data appended", data)
+	}
+	if data, _ := mock.File("new"); string(data) != testData {
+		t.Errorf("got %q, expected %q", data, testData)
+	}
+	for _, cmd := range mock.Commands() {
+		if strings.HasPrefix(cmd, "REST") {
+			t.Errorf("unexpected %s", cmd)
+		}
+	}
+}
+
+func TestStorAtomic(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.StorAtomic("/pub/file.txt", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("/pub/file.txt"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+	var tmp string
+	for _, command := range mock.Commands() {
+		if strings.HasPrefix(command, "STOR ") {
+			tmp = strings.TrimPrefix(command, "STOR ")
+		}
+	}
+	if !strings.HasPrefix(tmp, "/pub/.file.txt.") || !strings.HasSuffix(tmp, ".tmp") {
+		t.Fatalf("uploaded to %q, expected a temporary name", tmp)
+	}
+	if _, ok := mock.File(tmp); ok {
+		t.Error("the temporary file was not renamed")
+	}
+
+	// the temporary file is removed when the upload fails
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		data, ok := s.Receive()
+		if !ok {
+			return
+		}
+		s.m.SetFile(arg, data)
+		s.Reply(StatusExceededStorage, "Quota exceeded")
+	})
+	if err = c.StorAtomic("/pub/other.txt", bytes.NewBufferString(testData)); err == nil {
+		t.Fatal("expected an error")
+	}
+	commands := mock.Commands()
+	stor := commands[len(commands)-2]
+	if last := commands[len(commands)-1]; last != "DELE "+strings.TrimPrefix(stor, "STOR ") {
+		t.Errorf("got %q after %q, expected the temporary file to be deleted", last, stor)
+	}
+	if _, ok := mock.File("/pub/other.txt"); ok {
+		t.Error("the file was created despite the failure")
+	}
+}
+
+func TestSizeVerification(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("binary", []byte("line 1\nline 2\n"))
+	mock.SetFile("file", []byte(testData))
+	// a server sending the files in ASCII despite TYPE I
+	mock.Handle("RETR", func(s *mockSession, arg string) {
+		data, _ := s.m.File(arg)
+		s.Send(bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1))
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetSizeVerification(true)
+	r, err := c.Retr("binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != ErrTransferTypeMismatch {
+		t.Errorf("got error %v, expected ErrTransferTypeMismatch", err)
+	}
+
+	r, err = c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("got error %v for a file without line endings", err)
+	}
+}
+
+func TestPostStorVerify(t *testing.T) {
+	defer func(timeout time.Duration) { postStorTimeout = timeout }(postStorTimeout)
+	postStorTimeout = 200 * time.Millisecond
+
+	mock := newFtpMock(t)
+	defer mock.Close()
+	var sizes int32
+	mock.Handle("SIZE", func(s *mockSession, arg string) {
+		// the upload is committed after two SIZE commands, never for "lost"
+		if atomic.AddInt32(&sizes, 1) <= 2 || arg == "lost" {
+			s.Reply(StatusFile, "0")
+			return
+		}
+		s.handle("SIZE", arg)
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetPostStorVerify(true)
+
+	if err = c.Stor("file", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&sizes); n != 3 {
+		t.Errorf("got %d SIZE commands, expected 3", n)
+	}
+	err = c.Stor("lost", bytes.NewBufferString(testData))
+	if !errors.Is(err, ErrUploadNotVisible) {
+		t.Errorf("got error %v, expected ErrUploadNotVisible", err)
+	}
+}
+
+func TestRetrTo(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf bytes.Buffer
+	n, err := c.RetrTo("file", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(testData)) || buf.String() != testData {
+		t.Errorf("got %d bytes %q, expected %q", n, buf.String(), testData)
+	}
+	if _, err = c.RetrTo("missing", &buf); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+	// the connection is usable after the transfers
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetrRetry(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	var attempt int32
+	mock.Handle("RETR", func(s *mockSession, arg string) {
+		data := []byte(testData)[s.rest:]
+		s.rest = 0
+		switch atomic.AddInt32(&attempt, 1) {
+		case 1:
+			// the data connection breaks after a few bytes
+			s.Reply(StatusAboutToSend, "Opening data connection")
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(data[:5])
+			conn.Close()
+			s.Reply(StatusTransfertAborted, "Connection closed; transfer aborted")
+		case 2:
+			// then the control connection
+			s.conn.Close()
+		default:
+			s.Send(data)
+		}
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.RetrRetry("file", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != testData {
+		t.Errorf("got %q, expected %q", data, testData)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if !containsCommand(mock.Commands(), "REST 5") {
+		t.Errorf("expected the transfer to resume at 5, got %v", mock.Commands())
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestRetrTransform(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write([]byte(strings.Repeat(testData, 1000)))
+	w.Close()
+	mock.SetFile("/file.gz", compressed.Bytes())
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	var recorder *closeRecorder
+	r, err := c.RetrTransform("/file.gz", func(r io.Reader) io.Reader {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder = &closeRecorder{Reader: zr}
+		return recorder
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(testData))
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != testData {
+		t.Errorf("got %q, expected %q", buf, testData)
+	}
+	// closing the partially read transfer leaves the connection usable
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if !recorder.closed {
+		t.Error("the transforming reader was not closed")
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorRetry(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewBufferString(testData)), nil
+	}
+
+	// an aborted transfer, then a dropped connection
+	var attempt int32
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		data, ok := s.Receive()
+		if !ok {
+			return
+		}
+		// the attempts are made on different control connections
+		switch atomic.AddInt32(&attempt, 1) {
+		case 1:
+			s.Reply(StatusTransfertAborted, "Connection reset")
+		case 2:
+			s.conn.Close()
+		default:
+			s.m.SetFile(arg, data)
+			s.Reply(StatusClosingDataConnection, "Transfer complete")
+		}
+	})
+	if err = c.StorRetry("file", open, 3); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("file"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+	if opened != 3 {
+		t.Errorf("source opened %d times, expected 3", opened)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+
+	// a permanent error
+	opened = 0
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		s.Reply(StatusBadFileName, "Permission denied")
+	})
+	err = c.StorRetry("file", open, 3)
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusBadFileName {
+		t.Errorf("got error %v, expected a %d reply", err, StatusBadFileName)
+	}
+	if opened != 1 {
+		t.Errorf("source opened %d times, expected once", opened)
+	}
+}
+
+func TestStorResume(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("resume", []byte(testData[:5]))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.StorResume("resume", bytes.NewReader([]byte(testData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("resume"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+	if commands := mock.Commands(); commands[len(commands)-2] != "APPE resume" {
+		t.Errorf("commands %v, expected APPE", commands)
+	}
+
+	err = c.StorResume("new", bytes.NewReader([]byte(testData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("new"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+}
+
+func TestListDirs(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 .",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 ..",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dirs, err := c.ListDirs("/pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 || dirs[0].Name != "releases" {
+		t.Errorf("unexpected directories: %v", dirs)
+	}
+}
+
+func TestListCallback(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 zzz.msg",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var names []string
+	errStop := errors.New("stop")
+	err = c.ListCallback("/pub", func(entry *Entry) error {
+		names = append(names, entry.Name)
+		if len(names) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("got error %v, expected the error of the callback", err)
+	}
+	if len(names) != 2 || names[0] != "releases" || names[1] != "welcome.msg" {
+		t.Errorf("unexpected entries: %v", names)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Errorf("control connection out of sync: %v", err)
+	}
+}
+
+func TestListHeaderLines(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"Welcome to the archive.",
+		"Listing of /pub, 2 entries:",
+		"",
+		"total 8",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+		"Total of 2 files, 954 bytes.",
+	)
+	mock.SetListing("/mlsd",
+		"This server is monitored; be nice.",
+		"total 1",
+		"type=file;size=951;modify=20091202000000; welcome.msg",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, err := c.List("/pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "releases" || entries[1].Name != "welcome.msg" {
+		t.Errorf("got entries %v, expected the header lines to be skipped", entries)
+	}
+
+	c.ForceMLSD(true)
+	entries, err = c.List("/mlsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "welcome.msg" {
+		t.Errorf("got entries %v, expected the header lines to be skipped", entries)
+	}
+}
+
+func TestPreciseListTimes(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 a.txt",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 b.txt",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 c.txt",
+	)
+	mock.Handle("MDTM", func(s *mockSession, arg string) {
+		switch arg {
+		case "/pub/a.txt":
+			s.Reply(StatusFile, "20091202103001")
+		case "/pub/c.txt":
+			s.Reply(StatusFile, "20091202103003")
+		default:
+			s.Reply(StatusFileUnavailable, "No such file")
+		}
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetPreciseListTimes(2)
+	entries, err := c.List("/pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := time.Date(2009, time.December, 2, 0, 0, 0, 0, time.UTC)
+	expected := []time.Time{
+		listed,
+		time.Date(2009, time.December, 2, 10, 30, 1, 0, time.UTC),
+		listed,
+		time.Date(2009, time.December, 2, 10, 30, 3, 0, time.UTC),
+	}
+	for i, entry := range entries {
+		if !entry.Time.Equal(expected[i]) {
+			t.Errorf("%s: got time %v, expected %v", entry.Name, entry.Time, expected[i])
+		}
+	}
+	if containsCommand(mock.Commands(), "MDTM /pub/releases") {
+		t.Error("MDTM sent for a directory")
+	}
+	if err = c.NoOp(); err != nil {
+		t.Errorf("control connection out of sync: %v", err)
+	}
+}
+
+func TestListEmpty(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		switch arg {
+		case "/empty450":
+			s.Reply(StatusFileActionIgnored, "No files found")
+		case "/empty550":
+			s.Reply(StatusFileUnavailable, "No files found")
+		case "/missing":
+			s.Reply(StatusFileUnavailable, "No such file or directory")
+		case "/denied":
+			s.Reply(StatusFileUnavailable, "Permission denied")
+		default:
+			// an empty data connection
+			s.handle("LIST", arg)
+		}
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, dir := range []string{"/empty", "/empty450", "/empty550"} {
+		entries, err := c.List(dir)
+		if err != nil || len(entries) != 0 {
+			t.Errorf("List(%s) = %v, %v, expected an empty listing", dir, entries, err)
+		}
+	}
+	for _, dir := range []string{"/missing", "/denied"} {
+		if _, err = c.List(dir); err == nil {
+			t.Errorf("List(%s): expected an error", dir)
+		}
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListAll(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/etc",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 app.conf",
+	)
+	// the mock takes the flag as part of the path
+	mock.SetListing("-a /etc",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 .apprc",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 app.conf",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetListAll(true)
+	entries, err := c.List("/etc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !containsCommand(mock.Commands(), "LIST -a /etc") {
+		t.Errorf("expected LIST -a in %v", mock.Commands())
+	}
+	if len(entries) != 2 || entries[0].Name != ".apprc" {
+		t.Errorf("got entries %v, expected the hidden file", entries)
+	}
+}
+
+func TestListPaged(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, cursor, err := c.ListPaged("/pub", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || cursor != "" {
+		t.Errorf("got %d entries and cursor %q, expected the whole listing", len(entries), cursor)
+	}
+	if _, _, err = c.ListPaged("/pub", 1, "unknown"); err == nil {
+		t.Error("expected error for an unknown cursor, got nil")
+	}
+}
+
+func TestStatViaList(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub/welcome.msg",
+		"total 1",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+	)
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entry, err := c.StatViaList("/pub/welcome.msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Name != "welcome.msg" || entry.Size != 951 || entry.Type != EntryTypeFile {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+
+	if _, err = c.StatViaList("/pub"); err == nil {
+		t.Error("expected error for several entries, got nil")
+	}
+	if _, err = c.StatViaList("/missing"); err == nil {
+		t.Error("expected error for no entry, got nil")
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListSkipsDirEntries(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "MLST type*;size*;modify*;")
+	mock.SetListing("/srv",
+		"type=cdir;modify=20150813224845;perm=flcdmpe;unique=803U2; /srv",
+		"type=pdir;modify=20150806235817;perm=flcdmpe;unique=802U2; /",
+		"type=dir;modify=20150806235817;perm=flcdmpe;unique=804U2; www",
+		"type=file;size=951;modify=20150813175250;perm=adfrw;unique=805U2; index.html",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	entries, err := c.List("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name != "www" || entries[1].Name != "index.html" {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+
+	c.IncludeDirEntries(true)
+	entries, err = c.List("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[0].Type != EntryTypeCurrent || entries[1].Type != EntryTypeParent {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+
+	dirs, err := c.ListDirs("/srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 || dirs[0].Name != "www" {
+		t.Errorf("unexpected directories: %v", dirs)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Symlink("releases/2", "current"); err != ErrUnsupported {
+		t.Errorf("got error %v, expected ErrUnsupported", err)
+	}
+
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandOK, "SITE SYMLINK command successful")
+	})
+	if err = c.Symlink("releases/2", "current"); err != nil {
+		t.Error(err)
+	}
+	if commands := mock.Commands(); commands[len(commands)-1] != "SITE SYMLINK releases/2 current" {
+		t.Errorf("last command %q", commands[len(commands)-1])
+	}
+}
+
+func TestStats(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	before := c.Stats()
+	if err = c.Stor("stats", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Retr("stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+
+	stats := c.Stats()
+	// EPSV + STOR, EPSV + RETR
+	if sent := stats.CommandsSent - before.CommandsSent; sent != 4 {
+		t.Errorf("%d commands sent, expected 4", sent)
+	}
+	if stats.BytesUploaded != int64(len(testData)) {
+		t.Errorf("%d bytes uploaded, expected %d", stats.BytesUploaded, len(testData))
+	}
+	if stats.BytesDownloaded != int64(len(testData)) {
+		t.Errorf("%d bytes downloaded, expected %d", stats.BytesDownloaded, len(testData))
+	}
+	if stats.AvgRTT <= 0 {
+		t.Errorf("average RTT %v, expected a positive duration", stats.AvgRTT)
+	}
+}
+
+// slowReader returns its data one byte at a time, waiting between each read.
+type slowReader struct {
+	data  []byte
+	delay time.Duration
+}
+
+func (r *slowReader) Read(buf []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	buf[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestTransferKeepAlive(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetTransferKeepAlive(5 * time.Millisecond)
+	err = c.Stor("slow", &slowReader{data: []byte(testData), delay: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("slow"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+
+	noops := 0
+	for _, cmd := range mock.Commands() {
+		if cmd == "NOOP" {
+			noops++
+		}
+	}
+	if noops == 0 {
+		t.Error("no NOOP sent during the transfer")
+	}
+
+	// the control connection must still be in sync
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+	if size, err := c.FileSize("slow"); err != nil || size != int64(len(testData)) {
+		t.Errorf("FileSize = %d, %v", size, err)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.FreeSpace("/"); err != ErrUnsupported {
+		t.Errorf("got error %v, expected ErrUnsupported", err)
+	}
+
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.proto.PrintfLine("200-Filesystem 1K-blocks Used Available Use%% Mounted on")
+		s.proto.PrintfLine("200-/dev/sda1 1000 400 600 40%% /")
+		s.Reply(StatusCommandOK, "End")
+	})
+	if avail, err := c.FreeSpace("/"); err != nil || avail != 600*1024 {
+		t.Errorf("FreeSpace = %d, %v, expected %d", avail, err, 600*1024)
+	}
+
+	mock.Handle("AVBL", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "123456")
+	})
+	if avail, err := c.FreeSpace("/"); err != nil || avail != 123456 {
+		t.Errorf("FreeSpace = %d, %v, expected 123456", avail, err)
+	}
+}
+
+func TestAvailable(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err = c.Available("/"); err != ErrUnsupported {
+		t.Errorf("Available without AVBL feature = %v, expected ErrUnsupported", err)
+	}
+
+	mock.features = append(mock.features, "AVBL")
+	mock.Handle("AVBL", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "1048576 bytes available in "+arg)
+	})
+	c, err = DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if avail, err := c.Available("/pub"); err != nil || avail != 1048576 {
+		t.Errorf("Available = %d, %v, expected 1048576", avail, err)
+	}
+}
+
+func TestEventHandler(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	var events []Event
+	c, err := DialTimeout(mock.Addr(), 5*time.Second, WithEventHandler(func(e Event) {
+		events = append(events, e)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Stor("events", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Retr("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(r)
+	r.Close()
+	if _, err = c.Retr("missing"); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	expected := []EventType{
+		EventConnectStart,
+		EventLoginSuccess,
+		EventTransferStart, EventDataConnection, EventTransferComplete,
+		EventTransferStart, EventDataConnection, EventTransferComplete,
+		EventTransferStart, EventDataConnection, EventError,
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("got events %v, expected types %v", events, expected)
+	}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Errorf("event %d has type %d, expected %d", i, e.Type, expected[i])
+		}
+	}
+	if events[0].Addr != mock.Addr() || events[1].User != "anonymous" {
+		t.Errorf("unexpected events %v", events[:2])
+	}
+	if events[3].Method != "EPSV" || !strings.HasPrefix(events[3].Addr, "127.0.0.1:") {
+		t.Errorf("unexpected data connection event %+v", events[3])
+	}
+	if events[4].Path != "events" || events[4].Bytes != int64(len(testData)) {
+		t.Errorf("unexpected upload event %+v", events[4])
+	}
+	if events[7].Bytes != int64(len(testData)) {
+		t.Errorf("unexpected download event %+v", events[7])
+	}
+	if events[10].Op != "retr" || events[10].Err == nil {
+		t.Errorf("unexpected error event %+v", events[10])
+	}
+}
+
+func TestSetWorkingDir(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetWorkingDir("/pub/releases/"); err != nil {
+		t.Error(err)
+	}
+	if err = c.SetWorkingDir("relative"); err == nil {
+		t.Error("expected error for a relative path, got nil")
+	}
+
+	// a server jailing the user in its home directory
+	mock.Handle("PWD", func(s *mockSession, arg string) {
+		s.Reply(StatusPathCreated, `"/home/jail" is the current directory`)
+	})
+	if err = c.SetWorkingDir("/pub"); err == nil {
+		t.Error("expected error for a mismatching directory, got nil")
+	}
+}
+
+func TestIsChrooted(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if chrooted, err := c.IsChrooted(); err != nil || !chrooted {
+		t.Errorf("IsChrooted() = %v, %v with the home at the root", chrooted, err)
+	}
+
+	if err = c.ChangeDir("/home/alice"); err != nil {
+		t.Fatal(err)
+	}
+	if chrooted, err := c.IsChrooted(); err != nil || chrooted {
+		t.Errorf("IsChrooted() = %v, %v with a reachable home", chrooted, err)
+	}
+
+	// a server reporting the real path of the home outside of the jail
+	mock.Handle("CWD", func(s *mockSession, arg string) {
+		s.Reply(StatusFileUnavailable, "No such directory")
+	})
+	if chrooted, err := c.IsChrooted(); err != nil || !chrooted {
+		t.Errorf("IsChrooted() = %v, %v with an unreachable home", chrooted, err)
+	}
+}
+
+func TestCloseBehavior(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("REIN", func(s *mockSession, arg string) {
+		s.Reply(StatusNotImplemented, "REIN not implemented")
+	})
+
+	// the default does not send REIN
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Error(err)
+	}
+
+	c, err = DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCloseBehavior(QuitAndWait)
+	if err = c.Close(); err != nil {
+		t.Error(err)
+	}
+	if containsCommand(mock.Commands(), "REIN") {
+		t.Errorf("unexpected REIN in %v", mock.Commands())
+	}
+
+	c, err = DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetCloseBehavior(ReinThenQuit)
+	if err = c.Close(); err == nil {
+		t.Error("expected error for the rejected REIN, got nil")
+	}
+	if !containsCommand(mock.Commands(), "REIN") {
+		t.Errorf("expected REIN in %v", mock.Commands())
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("MKD", func(s *mockSession, arg string) {
+		if arg == "/pub" {
+			s.Reply(StatusFileUnavailable, "File exists")
+			return
+		}
+		s.Reply(StatusPathCreated, fmt.Sprintf("%q created", arg))
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.WriteFile("/pub/new/file.txt", []byte(testData), true); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("/pub/new/file.txt"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+	commands := mock.Commands()
+	if !containsCommand(commands, "MKD /pub") || !containsCommand(commands, "MKD /pub/new") {
+		t.Errorf("expected the parent directories to be created, got %v", commands)
+	}
+
+	// the directory exists already
+	if err = c.MakeDirAll("/pub/"); err != nil {
+		t.Error(err)
+	}
+	if dir, err := c.CurrentDir(); err != nil || dir != "/" {
+		t.Errorf("working directory %q, %v, expected /", dir, err)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if banner := c.Banner(); banner != "Mock FTP server ready" {
+		t.Errorf("got banner %q", banner)
+	}
+	if software := c.ServerSoftware(); software != "" {
+		t.Errorf("got server software %q for an unknown server", software)
+	}
+}
+
+func TestDefaultMode(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandOK, "SITE CHMOD command successful")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDefaultMode(0664, 0775)
+	if err = c.MakeDir("/pub/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Stor("/pub/dir/file", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	commands := mock.Commands()
+	if !containsCommand(commands, "SITE CHMOD 775 /pub/dir") || !containsCommand(commands, "SITE CHMOD 664 /pub/dir/file") {
+		t.Errorf("expected the default modes to be applied, got %v", commands)
+	}
+}
+
+func TestDefaultModeUnsupported(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	var reported []error
+	c, err := DialTimeout(mock.Addr(), 5*time.Second, WithEventHandler(func(e Event) {
+		if e.Type == EventError && e.Op == "chmod" {
+			reported = append(reported, e.Err)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDefaultMode(0664, 0)
+	for _, name := range []string{"a", "b"} {
+		if err = c.Stor(name, bytes.NewBufferString(testData)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chmods := 0
+	for _, command := range mock.Commands() {
+		if strings.HasPrefix(command, "SITE CHMOD") {
+			chmods++
+		}
+	}
+	if chmods != 1 {
+		t.Errorf("%d SITE CHMOD commands, expected the client to give up after the first one", chmods)
+	}
+	if len(reported) != 1 || reported[0] != ErrUnsupported {
+		t.Errorf("got errors %v reported, expected ErrUnsupported once", reported)
+	}
+}
+
+func TestDefaultModeFailed(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.Reply(StatusFileUnavailable, "Permission denied")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetDefaultMode(0664, 0)
+	err = c.Stor("file", bytes.NewBufferString(testData))
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusFileUnavailable {
+		t.Errorf("got error %v, expected the reply to SITE CHMOD", err)
+	}
+	if data, _ := mock.File("file"); string(data) != testData {
+		t.Errorf("uploaded %q, expected %q", data, testData)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	for _, crossRename := range []bool{true, false} {
+		mock := newFtpMock(t)
+		mock.SetFile("/in/report.csv", []byte(testData))
+		if !crossRename {
+			mock.Handle("RNTO", func(s *mockSession, arg string) {
+				s.Reply(StatusBadFileName, "Rename across directories not allowed")
+			})
+		}
+
+		c, err := DialTimeout(mock.Addr(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		day := time.Date(2023, time.March, 7, 12, 0, 0, 0, time.UTC)
+		dest, err := c.Archive("/in/report.csv", "/archive", day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest != "/archive/2023/03/07/report.csv" {
+			t.Errorf("archived to %q", dest)
+		}
+		if data, _ := mock.File(dest); string(data) != testData {
+			t.Errorf("archived file %q, expected %q", data, testData)
+		}
+		if _, ok := mock.File("/in/report.csv"); ok {
+			t.Error("the source file was not removed")
+		}
+		if !containsCommand(mock.Commands(), "MKD /archive/2023/03/07") {
+			t.Errorf("expected the dated directory to be created, got %v", mock.Commands())
+		}
+		c.Close()
+		mock.Close()
+	}
+
+	// the other errors are returned without copying the file
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("/in/report.csv", []byte(testData))
+	mock.Handle("RNTO", func(s *mockSession, arg string) {
+		s.Reply(StatusFileUnavailable, "Permission denied")
+	})
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Archive("/in/report.csv", "/archive", time.Now()); err == nil {
+		t.Error("expected an error for a refused rename, got nil")
+	}
+	if _, ok := mock.File("/in/report.csv"); !ok {
+		t.Error("the source file was removed")
+	}
+	for _, cmd := range mock.Commands() {
+		if strings.HasPrefix(cmd, "RETR") || strings.HasPrefix(cmd, "STOR") {
+			t.Errorf("got %s, expected no copy", cmd)
+		}
+	}
+}
+
+func TestStorExceededStorage(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.Accept()
+		if err != nil {
+			s.Reply(StatusCanNotOpenDataConnection, err.Error())
+			return
+		}
+		ioutil.ReadAll(conn)
+		conn.Close()
+		s.Reply(StatusExceededStorage, "Quota exceeded")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Stor("file", bytes.NewBufferString(testData))
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusExceededStorage {
+		t.Errorf("got error %v, expected a %d reply", err, StatusExceededStorage)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Errorf("control connection out of sync: %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	cmds := []string{"NOOP", "SITE UMASK 002", "TYPE A"}
+	results, err := c.Batch(true, cmds...)
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusBadCommand {
+		t.Errorf("got error %v, expected a %d reply", err, StatusBadCommand)
+	}
+	if len(results) != 2 || results[0].Code != StatusCommandOK || results[1].Command != "SITE UMASK 002" {
+		t.Errorf("unexpected results %v", results)
+	}
+
+	results, err = c.Batch(false, cmds...)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+	if len(results) != 3 || results[2].Code != StatusCommandOK {
+		t.Errorf("unexpected results %v", results)
+	}
+}
+
+func TestSiteHelp(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.proto.PrintfLine("214-The following SITE commands are recognized")
+		s.proto.PrintfLine(" CHMOD")
+		s.proto.PrintfLine(" SYMLINK")
+		s.Reply(StatusHelp, "Direct comments to root")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	commands, err := c.SiteHelp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commands) != 2 || commands[0] != "CHMOD" || commands[1] != "SYMLINK" {
+		t.Errorf("unexpected SITE commands %v", commands)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("HELP", func(s *mockSession, arg string) {
+		if arg != "" {
+			s.Reply(StatusHelp, "Syntax: "+arg+" <sp> pathname")
+			return
+		}
+		s.proto.PrintfLine("214-The following commands are recognized:")
+		s.proto.PrintfLine(" CWD  RETR  STOR")
+		s.Reply(StatusHelp, "Help OK.")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	help, err := c.Help()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "The following commands are recognized:\n CWD  RETR  STOR\nHelp OK."
+	if help != expected {
+		t.Errorf("help %q, expected %q", help, expected)
+	}
+
+	help, err = c.Help("RETR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if help != "Syntax: RETR <sp> pathname" {
+		t.Errorf("unexpected help %q", help)
+	}
+}
+
+func TestRestartVerification(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetRestartVerification(true)
+
+	r, err := c.RetrFrom("file", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	r.Close()
+	if string(buf) != testData[5:] {
+		t.Errorf("read %q, expected %q", buf, testData[5:])
+	}
+
+	// a server accepting REST without taking the offset into account
+	mock.Handle("REST", func(s *mockSession, arg string) {
+		s.Reply(StatusRequestFilePending, "Restarting")
+	})
+	if _, err = c.RetrFrom("file", 5); err != ErrRestartIgnored {
+		t.Errorf("got error %v, expected ErrRestartIgnored", err)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Errorf("control connection out of sync: %v", err)
+	}
+}
+
+func TestRetrEarlyCompletion(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	data := bytes.Repeat([]byte(testData), 10000)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, preliminary := range []bool{true, false} {
+		// the final reply is sent before the data
+		mock.Handle("RETR", func(s *mockSession, arg string) {
+			if preliminary {
+				s.Reply(StatusAboutToSend, "Opening data connection")
+			}
+			conn, err := s.Accept()
+			if err != nil {
+				s.Reply(StatusCanNotOpenDataConnection, err.Error())
+				return
+			}
+			s.Reply(StatusClosingDataConnection, "Transfer complete")
+			conn.Write(data)
+			conn.Close()
+		})
+
+		r, err := c.Retr("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Error(err)
+		}
+		if err = r.Close(); err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Errorf("read %d bytes, expected %d", len(buf), len(data))
+		}
+		if err = c.NoOp(); err != nil {
+			t.Errorf("control connection out of sync: %v", err)
+		}
+	}
+}
+
+func TestRetrPartialRead(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("big", bytes.Repeat([]byte(testData), 100000))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, err := c.Retr("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(testData))
+	if _, err = io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+
+	// the control connection must still be in sync
+	if size, err := c.FileSize("big"); err != nil || size != int64(len(testData)*100000) {
+		t.Errorf("FileSize = %d, %v", size, err)
+	}
+}
+
+func TestPassiveMode(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	modes := []struct {
+		mode    PassiveMode
+		command string
+	}{
+		{EPSVFirst, "EPSV"},
+		{PASVFirst, "PASV"},
+		{EPSVOnly, "EPSV"},
+		{PASVOnly, "PASV"},
+	}
+	for _, m := range modes {
+		c.SetPassiveMode(m.mode)
+		r, err := c.Retr("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		commands := mock.Commands()
+		if command := commands[len(commands)-2]; command != m.command {
+			t.Errorf("passive mode %d issued %s, expected %s", m.mode, command, m.command)
+		}
+	}
+}
+
+func TestWithoutEPSV(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second, WithoutEPSV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if commands := mock.Commands(); containsCommand(commands, "EPSV") || !containsCommand(commands, "PASV") {
+		t.Errorf("expected PASV only, got %v", commands)
+	}
+}
+
+func TestStrictDataHost(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+	// a server advertising another address than its own
+	mock.Handle("PASV", func(s *mockSession, arg string) {
+		if port, ok := s.passive(); ok {
+			s.Reply(StatusPassiveMode, fmt.Sprintf("Entering Passive Mode (10,0,0,1,%d,%d)", port/256, port%256))
+		}
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second, WithoutEPSV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the advertised address is ignored by default
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	c.SetStrictDataHost(true)
+	if _, err = c.Retr("file"); err != ErrDataHostMismatch {
+		t.Errorf("got error %v, expected ErrDataHostMismatch", err)
+	}
+}
+
+func TestActiveMode(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("EPSV", func(s *mockSession, arg string) {
+		s.Reply(StatusCanNotOpenDataConnection, "Passive mode refused")
+	})
+	mock.Handle("PASV", func(s *mockSession, arg string) {
+		s.Reply(StatusCanNotOpenDataConnection, "Passive mode refused")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetActiveMode(true)
+
+	if err = c.Stor("file", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if string(data) != testData {
+		t.Errorf("got %q, expected %q", data, testData)
+	}
+	for _, cmd := range mock.Commands() {
+		if cmd == "EPSV" || cmd == "PASV" {
+			t.Errorf("unexpected %s in active mode", cmd)
+		}
+	}
+	if !strings.HasPrefix(mock.Commands()[len(mock.Commands())-2], "PORT 127,0,0,1,") {
+		t.Errorf("expected a PORT command before RETR, got %v", mock.Commands())
+	}
+}
+
+func TestActiveModeForeignHost(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("file", []byte(testData))
+	// another host connects first to the announced port
+	rogue := make(chan error, 1)
+	mock.Handle("PORT", func(s *mockSession, arg string) {
+		s.handle("PORT", arg)
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+		conn, err := dialer.Dial("tcp", s.active)
+		if err == nil {
+			conn.Write([]byte("injected"))
+			conn.Close()
+		}
+		rogue <- err
+	})
+
+	var rejected []error
+	c, err := DialTimeout(mock.Addr(), 5*time.Second, WithEventHandler(func(e Event) {
+		if e.Type == EventError && e.Op == "accept" {
+			rejected = append(rejected, e.Err)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetActiveMode(true)
+
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if err = <-rogue; err != nil {
+		t.Skipf("can not connect from 127.0.0.2: %v", err)
+	}
+	if string(data) != testData {
+		t.Errorf("got %q, expected %q", data, testData)
+	}
+	if len(rejected) != 1 || !errors.Is(rejected[0], ErrDataHostMismatch) {
+		t.Errorf("got errors %v reported, expected the foreign connection to be rejected", rejected)
+	}
+}
+
+func TestActiveModeEPRT(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "EPRT")
+	mock.SetFile("file", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetActiveMode(true)
+
+	r, err := c.Retr("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	commands := mock.Commands()
+	if !strings.HasPrefix(commands[len(commands)-2], "EPRT |1|127.0.0.1|") {
+		t.Errorf("expected an EPRT command before RETR, got %v", commands)
+	}
+}
+
+func TestFormatActiveAddr(t *testing.T) {
+	ipv4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2049}
+	if arg := formatEPRT(ipv4); arg != "|1|10.0.0.1|2049|" {
+		t.Errorf("formatEPRT(%v) = %q", ipv4, arg)
+	}
+	if arg := formatPORT(ipv4); arg != "10,0,0,1,8,1" {
+		t.Errorf("formatPORT(%v) = %q", ipv4, arg)
+	}
+	ipv6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}
+	if arg := formatEPRT(ipv6); arg != "|2|2001:db8::1|50000|" {
+		t.Errorf("formatEPRT(%v) = %q", ipv6, arg)
+	}
+}
+
+func TestModTime(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("MDTM", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "20230102030405.250")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ModTime("file"); err != ErrUnsupported {
+		t.Errorf("got error %v without the MDTM feature, expected ErrUnsupported", err)
+	}
+	c.Close()
+
+	mock.features = append(mock.features, "MDTM")
+	c, err = DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	modTime, err := c.ModTime("file")
+	if expected := time.Date(2023, 1, 2, 3, 4, 5, 250000000, time.UTC); err != nil || !modTime.Equal(expected) {
+		t.Errorf("ModTime = %v, %v, expected %v", modTime, err, expected)
+	}
+}
+
+func TestSetModTime(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	utime := true
+	mock.Handle("MFMT", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "Modify=20230102030405; file")
+	})
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		if !utime {
+			s.Reply(StatusBadCommand, "Unknown SITE command")
+			return
+		}
+		s.Reply(StatusCommandOK, "UTIME command successful")
+	})
+	modTime := time.Date(2023, 1, 2, 4, 4, 5, 0, time.FixedZone("CET", 3600))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetModTime("file", modTime); err != nil {
+		t.Error(err)
+	}
+	if !containsCommand(mock.Commands(), "SITE UTIME file 20230102030405 20230102030405 20230102030405 UTC") {
+		t.Errorf("expected SITE UTIME in %v", mock.Commands())
+	}
+	utime = false
+	if err = c.SetModTime("file", modTime); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("got error %v, expected ErrUnsupported", err)
+	}
+	c.Close()
+
+	mock.features = append(mock.features, "MFMT")
+	c, err = DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.SetModTime("file", modTime); err != nil {
+		t.Error(err)
+	}
+	if !containsCommand(mock.Commands(), "MFMT 20230102030405 file") {
+		t.Errorf("expected MFMT in %v", mock.Commands())
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	now, err := c.ServerTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skew := time.Since(now); skew < -time.Second || skew > time.Minute {
+		t.Errorf("server time %v too far from now", now)
+	}
+	mock.mu.Lock()
+	files := len(mock.files)
+	mock.mu.Unlock()
+	if files != 0 {
+		t.Error("the temporary file was not removed")
+	}
+
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandOK, "Current time is 20230102030405")
+	})
+	now, err = c.ServerTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2023, time.January, 2, 3, 4, 5, 0, time.UTC); !now.Equal(expected) {
+		t.Errorf("server time %v, expected %v", now, expected)
+	}
+}
+
+func TestStorChunked(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.StorChunked("chunked", bytes.NewBufferString(testData), 4); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("chunked"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+	stor, appe := 0, 0
+	for _, cmd := range mock.Commands() {
+		switch cmd {
+		case "STOR chunked":
+			stor++
+		case "APPE chunked":
+			appe++
+		}
+	}
+	if stor != 1 || appe != 3 {
+		t.Errorf("%d STOR and %d APPE, expected 1 and 3", stor, appe)
+	}
+
+	// resume an interrupted upload
+	mock.SetFile("resumed", []byte(testData[:6]))
+	if err = c.StorChunked("resumed", bytes.NewBufferString(testData), 4); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := mock.File("resumed"); string(data) != testData {
+		t.Errorf("remote file %q, expected %q", data, testData)
+	}
+}
+
+func TestEquivalentCodes(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("CWD", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandOK, "Directory changed")
+	})
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		if _, ok := s.Receive(); ok {
+			s.Reply(StatusRequestedFileActionOK, "Transfer complete")
+		}
+	})
+	mock.Handle("MKD", func(s *mockSession, arg string) {
+		s.Reply(StatusFileUnavailable, "Permission denied")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.ChangeDir("pub"); err != nil {
+		t.Error(err)
+	}
+	if err = c.Stor("file", bytes.NewBufferString(testData)); err != nil {
+		t.Error(err)
+	}
+	if err = c.MakeDir("pub"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestStatRaw(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("/docs/report.txt", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	facts, name, err := c.StatRaw("/docs/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "/docs/report.txt" {
+		t.Errorf("name %q, expected /docs/report.txt", name)
+	}
+	if facts["size"] != "14" || facts["media-type"] != "text/plain" || facts["type"] != "file" {
+		t.Errorf("unexpected facts %v", facts)
+	}
+
+	if _, _, err = c.StatRaw("missing"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestMakeDirPath(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("MKD", func(s *mockSession, arg string) {
+		switch arg {
+		case "bare":
+			s.Reply(StatusPathCreated, "Directory created")
+		default:
+			s.Reply(StatusPathCreated, fmt.Sprintf("\"/home/anonymous/%s\" created", arg))
+		}
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if dir, err := c.MakeDirPath("uploads"); err != nil || dir != "/home/anonymous/uploads" {
+		t.Errorf("MakeDirPath = %q, %v, expected /home/anonymous/uploads", dir, err)
+	}
+	if dir, err := c.MakeDirPath("bare"); err != nil || dir != "bare" {
+		t.Errorf("MakeDirPath = %q, %v, expected bare", dir, err)
+	}
+}
+
+func TestPathType(t *testing.T) {
+	for _, mlst := range []bool{true, false} {
+		mock := newFtpMock(t)
+		mock.SetFile("/file", []byte(testData))
+		if mlst {
+			mock.features = append(mock.features, "MLST type*;size*;modify*;")
+		}
+		mock.Handle("MLST", func(s *mockSession, arg string) {
+			if arg != "/dir" {
+				s.handle("MLST", arg)
+				return
+			}
+			s.proto.PrintfLine("%d-Listing %s", StatusRequestedFileActionOK, arg)
+			s.proto.PrintfLine(" type=dir;modify=20230102030405; %s", arg)
+			s.Reply(StatusRequestedFileActionOK, "End")
+		})
+		mock.Handle("CWD", func(s *mockSession, arg string) {
+			if arg == "/missing" {
+				s.Reply(StatusFileUnavailable, "No such directory")
+				return
+			}
+			s.handle("CWD", arg)
+		})
+
+		c, err := DialTimeout(mock.Addr(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			path   string
+			kind   EntryType
+			exists bool
+		}{
+			{"/file", EntryTypeFile, true},
+			{"/dir", EntryTypeFolder, true},
+			{"/missing", 0, false},
+		} {
+			kind, exists, err := c.PathType(test.path)
+			if err != nil || kind != test.kind || exists != test.exists {
+				t.Errorf("PathType(%q) with MLST %v = %v, %v, %v, expected %v, %v",
+					test.path, mlst, kind, exists, err, test.kind, test.exists)
+			}
+		}
+		if dir, err := c.CurrentDir(); err != nil || dir != "/" {
+			t.Errorf("current directory %q, %v, expected /", dir, err)
+		}
+		c.Close()
+		mock.Close()
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("DELE", func(s *mockSession, arg string) {
+		time.Sleep(200 * time.Millisecond)
+		s.Reply(StatusRequestedFileActionOK, "Deleted")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetCommandTimeout(50 * time.Millisecond)
+	if err = c.NoOp(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Suspect() {
+		t.Error("connection suspect before any timeout")
+	}
+	if err = c.Remove("file"); err != ErrCommandTimeout {
+		t.Errorf("got error %v, expected ErrCommandTimeout", err)
+	}
+	if !c.Suspect() {
+		t.Error("connection not marked as suspect")
+	}
+}
+
+func TestAcceptedCodes(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	// a server answering MKD with a code reserved for other replies
+	mock.Handle("MKD", func(s *mockSession, arg string) {
+		s.Reply(StatusFileActionIgnored, "Directory created")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.MakeDir("dir"); err == nil {
+		t.Error("expected an error before accepting the code")
+	}
+	c.SetAcceptedCodes("mkd", StatusFileActionIgnored)
+	if err = c.MakeDir("dir"); err != nil {
+		t.Error(err)
+	}
+	c.SetAcceptedCodes("MKD")
+	if err = c.MakeDir("dir"); err == nil {
+		t.Error("expected an error once the code is no longer accepted")
+	}
+
+	// the commands of several words
+	mock.Handle("SITE", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandNotImplemented, "CHMOD done")
+	})
+	if err = c.Chmod("file", 0644); err == nil {
+		t.Error("expected an error before accepting the code")
+	}
+	c.SetAcceptedCodes("site chmod", StatusCommandNotImplemented)
+	if err = c.Chmod("file", 0644); err != nil {
+		t.Error(err)
+	}
+
+	// the transfer commands
+	mock.Handle("RETR", func(s *mockSession, arg string) {
+		s.Reply(StatusRequestedFileActionOK, "Sending")
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(testData))
+		conn.Close()
+		s.Reply(StatusClosingDataConnection, "Transfer complete")
+	})
+	c.SetAcceptedCodes("RETR", StatusRequestedFileActionOK)
+	var buf bytes.Buffer
+	if _, err = c.RetrTo("file", &buf); err != nil || buf.String() != testData {
+		t.Errorf("got %q, %v, expected %q", buf.String(), err, testData)
+	}
+}
+
+func TestPathTooLong(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("MKD", func(s *mockSession, arg string) {
+		if len(arg) > 16 {
+			s.Reply(StatusFileUnavailable, "File name too long")
+			return
+		}
+		s.Reply(StatusPathCreated, fmt.Sprintf("%q created", arg))
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.MakeDirAll("/deeply/nested/tree")
+	if !errors.Is(err, ErrPathTooLong) {
+		t.Errorf("got error %v, expected ErrPathTooLong", err)
+	}
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != StatusFileUnavailable {
+		t.Errorf("got error %v, expected the 550 reply to be kept", err)
+	}
+
+	// a path rejected as too long is not uploaded again
+	mock.Handle("STOR", func(s *mockSession, arg string) {
+		s.Reply(StatusFileUnavailable, "File name too long")
+	})
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewBufferString(testData)), nil
+	}
+	if err = c.StorRetry("/deeply/nested/file", open, 3); !errors.Is(err, ErrPathTooLong) {
+		t.Errorf("got error %v, expected ErrPathTooLong", err)
+	}
+	stor := 0
+	for _, cmd := range mock.Commands() {
+		if strings.HasPrefix(cmd, "STOR ") {
+			stor++
+		}
+	}
+	if stor != 1 {
+		t.Errorf("got %d STOR commands, expected 1", stor)
+	}
+
+	c.SetMaxPathLength(16)
+	sent := len(mock.Commands())
+	if err = c.Remove("/deeply/nested/file"); !errors.Is(err, ErrPathTooLong) {
+		t.Errorf("got error %v, expected ErrPathTooLong", err)
+	}
+	if _, err = c.List("/deeply/nested/tree"); !errors.Is(err, ErrPathTooLong) {
+		t.Errorf("got error %v, expected ErrPathTooLong", err)
+	}
+	if commands := mock.Commands(); len(commands) != sent {
+		t.Errorf("got commands %v despite the limit", commands[sent:])
+	}
+
+	// only the paths are limited, not the other arguments
+	if err = c.Login("anonymous", strings.Repeat("p", 32)); err != nil {
+		t.Errorf("got error %v logging in with a long password", err)
+	}
+}
+
+func TestUnsolicitedHandler(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.Handle("NOOP", func(s *mockSession, arg string) {
+		s.Reply(StatusCommandOK, "OK")
+		s.Reply(StatusNotAvailable, "Server will close in 5 minutes")
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var notices []string
+	c.SetUnsolicitedHandler(func(code int, msg string) {
+		notices = append(notices, fmt.Sprintf("%d %s", code, msg))
+	})
+	if err = c.NoOp(); err != nil {
+		t.Fatal(err)
+	}
+	// let the notice arrive before the next command
+	time.Sleep(50 * time.Millisecond)
+	if dir, err := c.CurrentDir(); err != nil || dir != "/" {
+		t.Errorf("got directory %q, %v, expected /", dir, err)
+	}
+	if len(notices) != 1 || notices[0] != "421 Server will close in 5 minutes" {
+		t.Errorf("got unsolicited messages %q", notices)
+	}
+
+	// the notices arriving between a command and its reply are passed too
+	notices = nil
+	mock.Handle("PWD", func(s *mockSession, arg string) {
+		s.Reply(StatusNotAvailable, "Server will close in 1 minute")
+		s.Reply(StatusAboutToSend, "Still there?")
+		s.handle("PWD", arg)
+	})
+	if dir, err := c.CurrentDir(); err != nil || dir != "/" {
+		t.Errorf("got directory %q, %v, expected /", dir, err)
+	}
+	if len(notices) != 2 || notices[0] != "421 Server will close in 1 minute" || notices[1] != "150 Still there?" {
+		t.Errorf("got unsolicited messages %q", notices)
+	}
+
+	// a 421 followed by the end of the connection is the reply
+	mock.Handle("NOOP", func(s *mockSession, arg string) {
+		s.Reply(StatusNotAvailable, "Shutting down")
+		s.conn.Close()
+	})
+	err = c.NoOp()
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusNotAvailable {
+		t.Errorf("got error %v, expected the 421 reply", err)
+	}
+}
+
+func TestTransferBufferSize(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetTransferBufferSize(1024)
+
+	data := bytes.Repeat([]byte(testData), 1000)
+	if err = c.Stor("file", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if remote, _ := mock.File("file"); !bytes.Equal(remote, data) {
+		t.Error("remote file differs from the uploaded one")
+	}
+}
+
+func BenchmarkTransferBufferSize(b *testing.B) {
+	data := bytes.Repeat([]byte{'x'}, 64<<20)
+	for _, size := range []int{32 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			mock := newFtpMock(nil)
+			defer mock.Close()
+
+			c, err := DialTimeout(mock.Addr(), 5*time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+			c.SetTransferBufferSize(size)
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err = c.Stor("big", bytes.NewReader(data)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// hashFuncs are the hash algorithms of the HASH FTP command computed locally
+// by DownloadVerified.
+var hashFuncs = map[string]func() hash.Hash{
+	"MD5":     md5.New,
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// hashAlgos returns the hash algorithms advertised by the HASH line of FEAT,
+// such as "SHA-256*;SHA-1;MD5", and the selected one, marked by a star.
+func (c *Client) hashAlgos() (algos []string, selected string) {
+	for _, algo := range strings.Split(c.features["HASH"], ";") {
+		algo = strings.TrimSpace(algo)
+		if strings.HasSuffix(algo, "*") {
+			algo = strings.TrimSuffix(algo, "*")
+			selected = algo
+		}
+		if algo != "" {
+			algos = append(algos, algo)
+		}
+	}
+	return algos, selected
+}
+
+// SetHashAlgo issues an OPTS HASH FTP command to select the algorithm used by
+// HashFile, which must be one of those the server advertises in its FEAT
+// reply. ErrUnsupported is returned when the server does not implement the
+// HASH command.
+func (c *Client) SetHashAlgo(algo string) error {
+	if _, ok := c.features["HASH"]; !ok {
+		return ErrUnsupported
+	}
+	algos, _ := c.hashAlgos()
+	found := false
+	for _, advertised := range algos {
+		if strings.EqualFold(advertised, algo) {
+			algo, found = advertised, true
+			break
+		}
+	}
+	if !found {
+		return errors.New("Unsupported hash algorithm: " + algo)
+	}
+	if _, _, err := c.cmd(StatusCommandOK, "OPTS HASH %s", algo); err != nil {
+		return unsupported(err)
+	}
+	c.hashAlgo = algo
+	return nil
+}
+
+// HashAlgo returns the algorithm used by HashFile: the one selected with
+// SetHashAlgo, or else the default of the server. It is empty when the server
+// does not implement the HASH command.
+func (c *Client) HashAlgo() string {
+	if c.hashAlgo != "" {
+		return c.hashAlgo
+	}
+	_, selected := c.hashAlgos()
+	return selected
+}
+
+// HashFile issues a HASH FTP command, which returns the hash of the file
+// computed by the server with the algorithm reported by HashAlgo, in
+// hexadecimal. ErrUnsupported is returned when the server does not implement
+// the HASH command.
+func (c *Client) HashFile(path string) (string, error) {
+	if _, ok := c.features["HASH"]; !ok {
+		return "", ErrUnsupported
+	}
+	_, msg, err := c.cmd(StatusFile, "HASH %s", path)
+	if err != nil {
+		return "", unsupported(err)
+	}
+	// 213 SHA-256 0-49 169cd22282da7f147cb491e559e9dd filename
+	fields := strings.Fields(msg)
+	if len(fields) < 3 {
+		return "", errors.New("Invalid HASH response format")
+	}
+	return strings.ToLower(fields[2]), nil
+}
+
+// DownloadVerified is like Download, but the hash of the downloaded data is
+// compared with the one computed by the server, see HashFile, and the local
+// file is left untouched when they differ. ErrUnsupported is returned when
+// the server does not implement the HASH command, or uses an algorithm not
+// known by this package.
+func (c *Client) DownloadVerified(remote, local string) error {
+	newHash, ok := hashFuncs[strings.ToUpper(c.HashAlgo())]
+	if !ok {
+		return ErrUnsupported
+	}
+	h := newHash()
+	return c.download(remote, local, h, func() error {
+		expected, err := c.HashFile(remote)
+		if err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+			return fmt.Errorf("%w: %s, expected %s", ErrChecksumMismatch, sum, expected)
+		}
+		return nil
+	})
+}
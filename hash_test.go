@@ -0,0 +1,125 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashFile(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "HASH SHA-256*;SHA-1;MD5")
+	mock.Handle("HASH", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "MD5 0-14 D41D8CD98F00B204E9800998ECF8427E "+arg)
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if algo := c.HashAlgo(); algo != "SHA-256" {
+		t.Errorf("got default algorithm %q, expected SHA-256", algo)
+	}
+	if err = c.SetHashAlgo("CRC32"); err == nil {
+		t.Error("expected an error for an algorithm not advertised")
+	}
+	if err = c.SetHashAlgo("md5"); err != nil {
+		t.Fatal(err)
+	}
+	if !containsCommand(mock.Commands(), "OPTS HASH MD5") {
+		t.Errorf("expected OPTS HASH MD5 in %v", mock.Commands())
+	}
+	if algo := c.HashAlgo(); algo != "MD5" {
+		t.Errorf("got algorithm %q, expected MD5", algo)
+	}
+
+	hash, err := c.HashFile("/pub/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("got hash %q", hash)
+	}
+}
+
+func TestHashUnsupported(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetHashAlgo("SHA-1"); err != ErrUnsupported {
+		t.Errorf("SetHashAlgo: got error %v, expected ErrUnsupported", err)
+	}
+	if _, err = c.HashFile("/pub/file.txt"); err != ErrUnsupported {
+		t.Errorf("HashFile: got error %v, expected ErrUnsupported", err)
+	}
+}
+
+func TestDownloadVerified(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "HASH SHA-256*;SHA-1;MD5")
+	sum := sha256.Sum256([]byte(testData))
+	mock.SetFile("/good", []byte(testData))
+	mock.SetFile("/corrupted", []byte(testData[1:]))
+	mock.Handle("HASH", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "SHA-256 0-14 "+hex.EncodeToString(sum[:])+" "+arg)
+	})
+
+	dir, err := ioutil.TempDir("", "ftp-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.DownloadVerified("/good", filepath.Join(dir, "good")); err != nil {
+		t.Error(err)
+	}
+	err = c.DownloadVerified("/corrupted", filepath.Join(dir, "corrupted"))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got error %v, expected ErrChecksumMismatch", err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || filepath.Base(names[0]) != "good" {
+		t.Errorf("got files %v, expected only good", names)
+	}
+}
@@ -0,0 +1,186 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// keepAlive sends NOOP commands on the control connection while a transfer
+// is in progress on the data connection.
+type keepAlive struct {
+	c    *Client
+	sent int
+	stop chan struct{}
+	done chan struct{}
+}
+
+// SetTransferKeepAlive makes Stor and Retr send a NOOP command on the control
+// connection every interval while the data is flowing, so that the server
+// does not close it during long transfers. The replies are read along with
+// the final reply of the transfer. An interval of 0 disables it.
+//
+// The server must accept commands during a transfer, which most do.
+func (c *Client) SetTransferKeepAlive(interval time.Duration) {
+	c.keepAliveInterval = interval
+}
+
+// startKeepAlive starts sending NOOP commands, it returns nil when disabled.
+func (c *Client) startKeepAlive() *keepAlive {
+	if c.keepAliveInterval <= 0 {
+		return nil
+	}
+	k := &keepAlive{
+		c:    c,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go k.run(c.keepAliveInterval)
+	return k
+}
+
+func (k *keepAlive) run(interval time.Duration) {
+	defer close(k.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+			if _, err := k.c.conn.Cmd("NOOP"); err != nil {
+				return
+			}
+			k.c.stats.sent()
+			k.sent++
+		}
+	}
+}
+
+// Stop stops sending NOOP commands and returns how many were sent.
+func (k *keepAlive) Stop() int {
+	if k == nil {
+		return 0
+	}
+	close(k.stop)
+	<-k.done
+	return k.sent
+}
+
+// transferResponse reads the final reply of a transfer, skipping the replies
+// to the NOOP commands sent meanwhile, which may come before or after it.
+func (c *Client) transferResponse(noops int) error {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+	c.transferring = false
+	noops -= c.statusNoops
+	c.statusNoops = 0
+
+	if reply := c.finalReply; reply != nil {
+		// the final reply came before the one to STAT, see TransferStatus
+		c.finalReply = nil
+		for ; noops > 0; noops-- {
+			if _, _, err := c.conn.ReadResponse(StatusCommandOK); err != nil {
+				return err
+			}
+		}
+		if !expectedCode(reply.Code, StatusClosingDataConnection) {
+			return reply
+		}
+		return nil
+	}
+	if c.transferDone {
+		// the final reply came along with the transfer command
+		c.transferDone = false
+		for ; noops > 0; noops-- {
+			if _, _, err := c.conn.ReadResponse(StatusCommandOK); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		code, msg, err := c.conn.ReadResponse(-1)
+		if err != nil {
+			return err
+		}
+		if code == StatusCommandOK && noops > 0 {
+			noops--
+			continue
+		}
+		// the preliminary replies sent during the transfer, such as progress
+		// reports or 110 MARK yyyy = mmmm in block mode, are skipped
+		if code < 200 {
+			if fields := strings.Fields(msg); code == StatusRestartMarker && len(fields) > 1 && fields[0] == "MARK" {
+				c.restartMarker = fields[1]
+			}
+			continue
+		}
+		for ; noops > 0; noops-- {
+			if _, _, err := c.conn.ReadResponse(StatusCommandOK); err != nil {
+				return err
+			}
+		}
+		if !expectedCode(code, StatusClosingDataConnection) {
+			return &textproto.Error{Code: code, Msg: msg}
+		}
+		return nil
+	}
+}
+
+// TransferStatus issues a STAT FTP command during a transfer, and returns the
+// progress reported by the server, such as the number of bytes it received.
+// Unlike the counters of Stats, this tells what the server has committed.
+//
+// It is meant to be called from another goroutine than the one running Stor,
+// or between the reads of the response of Retr, but not concurrently with any
+// other command. An error is returned when no transfer is in progress, and
+// ErrUnsupported when the server does not implement STAT during transfers.
+func (c *Client) TransferStatus() (string, error) {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+	if !c.transferring || c.finalReply != nil {
+		return "", errors.New("No transfer in progress")
+	}
+	if _, err := c.conn.Cmd("STAT"); err != nil {
+		return "", err
+	}
+	c.stats.sent()
+
+	for {
+		code, msg, err := c.conn.ReadResponse(-1)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case code < 200:
+			// preliminary replies of the transfer
+		case code == StatusCommandOK:
+			// reply to a NOOP of the keep-alive
+			c.statusNoops++
+		case code == StatusSystem || code == StatusDirectory || code == StatusFile:
+			return msg, nil
+		case code == StatusBadCommand || code == StatusBadArguments || code == StatusNotImplemented:
+			return "", ErrUnsupported
+		default:
+			// the transfer ended before the server replied to STAT
+			c.finalReply = &textproto.Error{Code: code, Msg: msg}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connLimitRetries is the number of times a connection rejected as one too
+// many is dialed again, connLimitBackoff apart at first, while the caller
+// holds no connection which could free a slot. The limits discovered expire
+// after connLimitTTL, as other clients may have held some of the
+// connections at the time.
+var (
+	connLimitRetries = 8
+	connLimitBackoff = 250 * time.Millisecond
+	connLimitTTL     = 5 * time.Minute
+)
+
+// connLimit is a connection limit discovered, valid until expires.
+type connLimit struct {
+	limit   int
+	expires time.Time
+}
+
+// connLimits holds the connection limits discovered by account and server.
+var connLimits = struct {
+	sync.Mutex
+	m map[string]connLimit
+}{m: make(map[string]connLimit)}
+
+// ConnectionLimit returns the number of concurrent connections the server
+// accepted for the account before rejecting one as too many, as discovered
+// by the helpers opening several connections such as ListMany, or 0 when no
+// limit was met in the last five minutes. The helpers then open no more
+// connections than the limit until it expires.
+func (cfg Config) ConnectionLimit() int {
+	connLimits.Lock()
+	defer connLimits.Unlock()
+	key := cfg.limitKey()
+	l, ok := connLimits.m[key]
+	if ok && !time.Now().Before(l.expires) {
+		delete(connLimits.m, key)
+		return 0
+	}
+	return l.limit
+}
+
+func (cfg Config) limitKey() string {
+	return cfg.User + "@" + cfg.address()
+}
+
+// dialWorkers opens up to n logged in connections, held is the number of
+// connections the caller already holds to the server. When the server
+// rejects a connection as one too many, the connections opened so far are
+// used and the limit is recorded; with no connection at all, the dial is
+// retried until another client frees a slot.
+func (cfg Config) dialWorkers(n, held int) ([]*Client, error) {
+	if limit := cfg.ConnectionLimit(); limit > 0 && n > limit-held {
+		n = limit - held
+		if n < 1 {
+			n = 1
+		}
+	}
+	conns := make([]*Client, 0, n)
+	backoff := connLimitBackoff
+	for retries := 0; len(conns) < n; {
+		c, err := cfg.Dial()
+		if err == nil {
+			conns = append(conns, c)
+			continue
+		}
+		if !tooManyConnections(err) {
+			closeAll(conns)
+			return nil, err
+		}
+		if len(conns)+held > 0 {
+			cfg.setConnectionLimit(len(conns) + held)
+		}
+		if len(conns) > 0 {
+			break
+		}
+		if retries == connLimitRetries {
+			return nil, err
+		}
+		retries++
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return conns, nil
+}
+
+func (cfg Config) setConnectionLimit(limit int) {
+	connLimits.Lock()
+	defer connLimits.Unlock()
+	connLimits.m[cfg.limitKey()] = connLimit{limit: limit, expires: time.Now().Add(connLimitTTL)}
+}
+
+// tooManyConnections reports whether the server rejected a connection or a
+// login because of its limit on concurrent connections, such as with "530
+// Too many connections" or "421 Too many users".
+func tooManyConnections(err error) bool {
+	e, ok := err.(*textproto.Error)
+	if !ok || (e.Code != StatusNotAvailable && e.Code != StatusNotLoggedIn) {
+		return false
+	}
+	msg := strings.ToLower(e.Msg)
+	return strings.Contains(msg, "too many") || strings.Contains(msg, "maximum")
+}
+
+// closeAll closes the connections.
+func closeAll(conns []*Client) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
@@ -0,0 +1,123 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listCache memoizes the listings returned by List.
+type listCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	listings map[string]cachedListing
+}
+
+// cachedListing is a listing held by the cache until it expires.
+type cachedListing struct {
+	entries []Entry
+	expires time.Time
+}
+
+// EnableListCache makes List keep the listings of the directories for ttl,
+// and return them again instead of listing the directories anew. A ttl of 0
+// disables the cache, which is the default.
+//
+// The listings of the directories are dropped as the client changes them, by
+// uploading, removing, renaming or creating files and directories. Changing
+// a relative path drops the whole cache, as does changing the current
+// directory. The changes made by other clients, or with RawCmd and Batch, are
+// only seen once the listings expire, or after a call to InvalidateListCache.
+func (c *Client) EnableListCache(ttl time.Duration) {
+	if ttl <= 0 {
+		c.listCache = nil
+		return
+	}
+	c.listCache = &listCache{ttl: ttl, listings: make(map[string]cachedListing)}
+}
+
+// InvalidateListCache drops the cached listing of the directory at path,
+// along with those of its subdirectories. A relative path drops the whole
+// cache.
+func (c *Client) InvalidateListCache(dir string) {
+	if c.listCache == nil {
+		return
+	}
+	c.listCache.invalidate(dir)
+}
+
+// invalidateParent drops the cached listings changed by a change of the file
+// or directory at name: the listing of its parent, and its own listing and
+// those below it for a directory.
+func (c *Client) invalidateParent(name string) {
+	if c.listCache == nil {
+		return
+	}
+	c.listCache.invalidate(path.Dir(path.Clean(name)))
+	c.listCache.invalidate(name)
+}
+
+// get returns a copy of the listing of dir, unless it is not cached or has
+// expired.
+func (lc *listCache) get(dir string) ([]*Entry, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	listing, ok := lc.listings[path.Clean(dir)]
+	if !ok || time.Now().After(listing.expires) {
+		return nil, false
+	}
+	entries := make([]*Entry, len(listing.entries))
+	for i := range listing.entries {
+		entry := listing.entries[i]
+		entries[i] = &entry
+	}
+	return entries, true
+}
+
+// put caches a copy of the listing of dir.
+func (lc *listCache) put(dir string, entries []*Entry) {
+	listing := cachedListing{
+		entries: make([]Entry, len(entries)),
+		expires: time.Now().Add(lc.ttl),
+	}
+	for i, entry := range entries {
+		listing.entries[i] = *entry
+	}
+	lc.mu.Lock()
+	lc.listings[path.Clean(dir)] = listing
+	lc.mu.Unlock()
+}
+
+// invalidate drops the listing of dir and of its subdirectories, or all the
+// listings for a relative path.
+func (lc *listCache) invalidate(dir string) {
+	dir = path.Clean(dir)
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if !strings.HasPrefix(dir, "/") {
+		lc.listings = make(map[string]cachedListing)
+		return
+	}
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for key := range lc.listings {
+		if key == dir || strings.HasPrefix(key, prefix) {
+			delete(lc.listings, key)
+		}
+	}
+}
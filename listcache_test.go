@@ -0,0 +1,101 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listCount returns the number of listings made on the mock server.
+func listCount(mock *ftpMock) int {
+	n := 0
+	for _, command := range mock.Commands() {
+		if strings.HasPrefix(command, "LIST ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestListCache(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 welcome.msg",
+	)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.EnableListCache(time.Minute)
+	for i := 0; i < 2; i++ {
+		entries, err := c.List("/pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name != "welcome.msg" {
+			t.Errorf("got entries %v", entries)
+		}
+		// the cached entries can not be altered by the callers
+		entries[0].Name = "changed"
+	}
+	if n := listCount(mock); n != 1 {
+		t.Errorf("%d listings, expected the second one to be cached", n)
+	}
+
+	// an upload in the directory drops its listing
+	if err = c.Stor("/pub/new.txt", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.List("/pub/"); err != nil {
+		t.Fatal(err)
+	}
+	if n := listCount(mock); n != 2 {
+		t.Errorf("%d listings, expected the listing to be invalidated by the upload", n)
+	}
+
+	c.InvalidateListCache("/")
+	if _, err = c.List("/pub"); err != nil {
+		t.Fatal(err)
+	}
+	if n := listCount(mock); n != 3 {
+		t.Errorf("%d listings, expected the listing to be invalidated", n)
+	}
+}
+
+func TestListCacheExpiry(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.EnableListCache(50 * time.Millisecond)
+	c.List("/pub")
+	time.Sleep(100 * time.Millisecond)
+	c.List("/pub")
+	if n := listCount(mock); n != 2 {
+		t.Errorf("%d listings, expected the cached listing to expire", n)
+	}
+}
@@ -0,0 +1,225 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// mirrorStateVersion is the version of the state files written by
+// MirrorDown, increased on incompatible changes of their format.
+const mirrorStateVersion = 1
+
+// The state file of MirrorDown is written once mirrorStateFiles files were
+// downloaded or mirrorStateInterval elapsed since it was last written, and
+// at the end of the mirror, rather than after every file.
+const (
+	mirrorStateFiles    = 100
+	mirrorStateInterval = 10 * time.Second
+)
+
+// MirrorState is the content of the state file of MirrorDown, stored as JSON:
+//
+//	{
+//		"version": 1,
+//		"files": {
+//			"/pub/welcome.msg": {"size": 951, "modTime": "2009-12-02T00:00:00Z"}
+//		}
+//	}
+//
+// Files maps the remote paths of the files downloaded successfully to their
+// size and modification time on the server when they were downloaded.
+type MirrorState struct {
+	Version int                     `json:"version"`
+	Files   map[string]MirroredFile `json:"files"`
+}
+
+// MirroredFile describes a file downloaded by MirrorDown.
+type MirroredFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// mirror holds the progress of MirrorDown.
+type mirror struct {
+	stateFile string
+	state     *MirrorState
+	result    *DownloadError
+
+	// pending is the number of files downloaded since the state file was
+	// written at flushed.
+	pending int
+	flushed time.Time
+}
+
+// MirrorDown copies the tree below remoteDir into localDir, creating the
+// local directories as needed. Local files are never removed.
+//
+// The files downloaded successfully are recorded in stateFile, see
+// MirrorState, which is written periodically and at the end of the mirror,
+// so that an interrupted mirror resumes close to where it stopped and
+// that the next ones only fetch the new and modified files: a file is
+// downloaded again when its size or modification time changed on the
+// server, or when its local copy is missing or has another size. The
+// modification times come from the MLSD listings, or from MDTM FTP commands,
+// falling back to the times of LIST.
+//
+// A *DownloadError is returned when some files could not be downloaded, the
+// following runs try them again.
+func (c *Client) MirrorDown(remoteDir, localDir, stateFile string) error {
+	state, err := readMirrorState(stateFile)
+	if err != nil {
+		return err
+	}
+	m := &mirror{
+		stateFile: stateFile,
+		state:     state,
+		result:    &DownloadError{Failed: make(map[string]error)},
+		flushed:   time.Now(),
+	}
+	err = c.mirrorDir(m, remoteDir, localDir)
+	if flushErr := m.flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return err
+	}
+	if len(m.result.Failed) > 0 {
+		return m.result
+	}
+	return nil
+}
+
+// mirrorDir mirrors the remote directory into the local one.
+func (c *Client) mirrorDir(m *mirror, remote, local string) error {
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return err
+	}
+	entries, err := c.List(remote)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		remotePath := path.Join(remote, entry.Name)
+		// a name from the server must not escape localDir
+		if path.Base(entry.Name) != entry.Name || filepath.Base(entry.Name) != entry.Name {
+			m.result.Failed[remotePath] = errors.New("Invalid file name")
+			continue
+		}
+		localPath := filepath.Join(local, entry.Name)
+
+		switch entry.Type {
+		case EntryTypeFolder:
+			err = c.mirrorDir(m, remotePath, localPath)
+		case EntryTypeFile:
+			err = c.mirrorFile(m, entry, remotePath, localPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorFile downloads the remote file unless its local copy is up to date,
+// and records it in the state file.
+func (c *Client) mirrorFile(m *mirror, entry *Entry, remote, local string) error {
+	file := MirroredFile{Size: int64(entry.Size), ModTime: entry.Time}
+	if !c.mlst {
+		if modTime, err := c.mdtm(remote); err == nil {
+			file.ModTime = modTime
+		}
+	}
+	if old, ok := m.state.Files[remote]; ok && old.Size == file.Size && old.ModTime.Equal(file.ModTime) {
+		if info, err := os.Stat(local); err == nil && info.Size() == file.Size {
+			return nil
+		}
+	}
+
+	if err := c.Download(remote, local); err != nil {
+		m.result.Failed[remote] = err
+		return nil
+	}
+	if !file.ModTime.IsZero() {
+		os.Chtimes(local, file.ModTime, file.ModTime)
+	}
+	m.state.Files[remote] = file
+	m.result.Downloaded++
+	m.pending++
+	if m.pending >= mirrorStateFiles || time.Since(m.flushed) >= mirrorStateInterval {
+		return m.flush()
+	}
+	return nil
+}
+
+// flush writes the state file when files were downloaded since it was last
+// written.
+func (m *mirror) flush() error {
+	if m.pending == 0 {
+		return nil
+	}
+	if err := writeMirrorState(m.stateFile, m.state); err != nil {
+		return err
+	}
+	m.pending = 0
+	m.flushed = time.Now()
+	return nil
+}
+
+// readMirrorState reads the state file of MirrorDown, which may not exist
+// yet.
+func readMirrorState(name string) (*MirrorState, error) {
+	state := &MirrorState{Version: mirrorStateVersion}
+	data, err := ioutil.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, state); err != nil {
+			return nil, err
+		}
+		if state.Version != mirrorStateVersion {
+			return nil, fmt.Errorf("Unsupported mirror state version: %d", state.Version)
+		}
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]MirroredFile)
+	}
+	return state, nil
+}
+
+// writeMirrorState replaces the state file of MirrorDown, atomically so that
+// an interruption does not leave it truncated.
+func writeMirrorState(name string, state *MirrorState) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
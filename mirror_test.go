@@ -0,0 +1,175 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// retrCount returns the number of files retrieved from the mock server.
+func retrCount(mock *ftpMock) int {
+	n := 0
+	for _, command := range mock.Commands() {
+		if strings.HasPrefix(command, "RETR ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMirrorDown(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 sub",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 a.txt",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 missing.txt",
+	)
+	mock.SetListing("/pub/sub",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 b.txt",
+	)
+	mock.SetFile("/pub/a.txt", []byte(testData))
+	mock.SetFile("/pub/sub/b.txt", []byte(testData))
+	mock.Handle("MDTM", func(s *mockSession, arg string) {
+		s.Reply(StatusFile, "20091202103000")
+	})
+
+	dir, err := ioutil.TempDir("", "ftp-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "pub")
+	stateFile := filepath.Join(dir, "state.json")
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.MirrorDown("/pub", local, stateFile)
+	derr, ok := err.(*DownloadError)
+	if !ok {
+		t.Fatalf("got error %v, expected a *DownloadError", err)
+	}
+	if derr.Downloaded != 2 || derr.Failed["/pub/missing.txt"] == nil {
+		t.Errorf("got %d files downloaded and failures %v", derr.Downloaded, derr.Failed)
+	}
+	for _, name := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+		data, err := ioutil.ReadFile(filepath.Join(local, name))
+		if err != nil || string(data) != testData {
+			t.Errorf("local file %s: %q, %v", name, data, err)
+		}
+	}
+	state, err := readMirrorState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2009, time.December, 2, 10, 30, 0, 0, time.UTC)
+	if file := state.Files["/pub/sub/b.txt"]; file.Size != 14 || !file.ModTime.Equal(modTime) {
+		t.Errorf("got state %+v for b.txt", file)
+	}
+	if _, ok := state.Files["/pub/missing.txt"]; ok {
+		t.Error("the missing file is recorded in the state")
+	}
+
+	// the files downloaded are up to date, only the missing one is retried
+	mock.SetFile("/pub/missing.txt", []byte(testData))
+	retrieved := retrCount(mock)
+	if err = c.MirrorDown("/pub", local, stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if n := retrCount(mock) - retrieved; n != 1 {
+		t.Errorf("%d files retrieved, expected only the missing one", n)
+	}
+
+	// a file whose size changed is downloaded again
+	mock.SetListing("/pub/sub",
+		"-rw-r--r--    1 110      1002           15 Dec 02  2009 b.txt",
+	)
+	mock.SetFile("/pub/sub/b.txt", []byte(testData+"!"))
+	retrieved = retrCount(mock)
+	if err = c.MirrorDown("/pub", local, stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if n := retrCount(mock) - retrieved; n != 1 {
+		t.Errorf("%d files retrieved, expected only the modified one", n)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(local, "sub", "b.txt")); string(data) != testData+"!" {
+		t.Errorf("local file %q after the modification", data)
+	}
+}
+
+func TestMirrorDownInterrupted(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 a.txt",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 sub",
+	)
+	mock.SetFile("/pub/a.txt", []byte(testData))
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		if arg == "/pub/sub" {
+			s.Reply(StatusActionAborted, "Local error in processing")
+			return
+		}
+		s.handle("LIST", arg)
+	})
+
+	dir, err := ioutil.TempDir("", "ftp-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.MirrorDown("/pub", filepath.Join(dir, "pub"), stateFile); err == nil {
+		t.Fatal("expected an error for the failed listing, got nil")
+	}
+	// the files downloaded before the error are recorded
+	state, err := readMirrorState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Files["/pub/a.txt"]; !ok {
+		t.Errorf("got state %v, expected a.txt to be recorded", state.Files)
+	}
+}
+
+func TestMirrorStateVersion(t *testing.T) {
+	f, err := ioutil.TempFile("", "ftp-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"version": 2, "files": {}}`)
+	f.Close()
+
+	if _, err = readMirrorState(f.Name()); err == nil {
+		t.Error("expected an error for an unknown state version")
+	}
+}
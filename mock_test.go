@@ -0,0 +1,577 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockHandler overrides the reply of the mock server for a command.
+type mockHandler func(s *mockSession, arg string)
+
+// ftpMock is a minimal FTP server listening on the loopback interface, used
+// to test the client without a real server. Files are kept in memory.
+type ftpMock struct {
+	t         *testing.T
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	// features are advertised as is in the FEAT reply
+	features []string
+	// handlers replace the default behaviour of the commands
+	handlers map[string]mockHandler
+
+	mu       sync.Mutex
+	commands []string
+	files    map[string][]byte
+	listings map[string][]string
+	// dataTLS records, for each data connection, whether it was encrypted
+	dataTLS []bool
+	// wireBytes counts the bytes received on the data connections
+	wireBytes int64
+}
+
+// mockSession is the state of a control connection to the mock server.
+type mockSession struct {
+	m      *ftpMock
+	conn   net.Conn
+	proto  *textproto.Conn
+	dataLn net.Listener
+	// active is the address announced by PORT
+	active string
+	prot   string
+	rest   int64
+	rnfr   string
+	cwd    string
+	mode   string
+}
+
+func newFtpMock(t *testing.T) *ftpMock {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &ftpMock{
+		t:        t,
+		listener: ln,
+		features: []string{"EPSV", "UTF8"},
+		handlers: make(map[string]mockHandler),
+		files:    make(map[string][]byte),
+		listings: make(map[string][]string),
+	}
+	go m.serve()
+	return m
+}
+
+// newFtpMockTLS returns a mock server accepting AUTH TLS, along with a client
+// configuration trusting its certificate.
+func newFtpMockTLS(t *testing.T) (*ftpMock, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ftp mock"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newFtpMock(t)
+	m.features = append(m.features, "AUTH TLS", "PBSZ", "PROT")
+	m.tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return m, &tls.Config{RootCAs: pool}
+}
+
+// Addr returns the address of the control connection listener.
+func (m *ftpMock) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// Close stops accepting new control connections.
+func (m *ftpMock) Close() {
+	m.listener.Close()
+}
+
+// Commands returns the commands received so far.
+func (m *ftpMock) Commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.commands...)
+}
+
+// File returns the content of an uploaded file.
+func (m *ftpMock) File(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	return data, ok
+}
+
+// SetFile stores a file on the mock server.
+func (m *ftpMock) SetFile(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = data
+}
+
+// Handle replaces the default behaviour of the mock server for a command.
+func (m *ftpMock) Handle(command string, h mockHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[command] = h
+}
+
+// SetListing sets the lines sent in reply to a listing of path.
+func (m *ftpMock) SetListing(path string, lines ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listings[path] = lines
+}
+
+// WireBytes returns the number of bytes received on the data connections.
+func (m *ftpMock) WireBytes() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.wireBytes
+}
+
+func (m *ftpMock) hasFeature(feature string) bool {
+	for _, f := range m.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// DataTLS reports whether each data connection so far was encrypted.
+func (m *ftpMock) DataTLS() []bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]bool(nil), m.dataTLS...)
+}
+
+func (m *ftpMock) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		s := &mockSession{m: m, conn: conn, proto: textproto.NewConn(conn), cwd: "/"}
+		go s.serve()
+	}
+}
+
+// Reply sends a reply to the client.
+func (s *mockSession) Reply(code int, msg string) {
+	s.proto.PrintfLine("%d %s", code, msg)
+}
+
+// Accept opens the data connection previously announced by EPSV or PASV,
+// or connects to the address announced by PORT.
+func (s *mockSession) Accept() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case s.dataLn != nil:
+		conn, err = s.dataLn.Accept()
+		s.dataLn.Close()
+		s.dataLn = nil
+	case s.active != "":
+		conn, err = net.Dial("tcp", s.active)
+		s.active = ""
+	default:
+		return nil, fmt.Errorf("no passive listener")
+	}
+	if err != nil {
+		return nil, err
+	}
+	encrypted := s.prot == "P"
+	s.m.mu.Lock()
+	s.m.dataTLS = append(s.m.dataTLS, encrypted)
+	s.m.mu.Unlock()
+	if encrypted {
+		tconn := tls.Server(conn, s.m.tlsConfig)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tconn, nil
+	}
+	return conn, nil
+}
+
+// Send transfers data to the client over a new data connection.
+func (s *mockSession) Send(data []byte) {
+	s.Reply(StatusAboutToSend, "Opening data connection")
+	conn, err := s.Accept()
+	if err != nil {
+		s.Reply(StatusCanNotOpenDataConnection, err.Error())
+		return
+	}
+	switch s.mode {
+	case "Z":
+		w := zlib.NewWriter(conn)
+		w.Write(data)
+		w.Close()
+	case "B":
+		// two blocks separated by a restart marker
+		half := len(data) / 2
+		marker := strconv.Itoa(half)
+		conn.Write(append([]byte{0, byte(half >> 8), byte(half)}, data[:half]...))
+		conn.Write(append([]byte{16, 0, byte(len(marker))}, marker...))
+		rest := len(data) - half
+		conn.Write(append([]byte{64, byte(rest >> 8), byte(rest)}, data[half:]...))
+	default:
+		conn.Write(data)
+	}
+	conn.Close()
+	s.Reply(StatusClosingDataConnection, "Transfer complete")
+}
+
+// Receive reads data from the client over a new data connection.
+func (s *mockSession) Receive() ([]byte, bool) {
+	s.Reply(StatusAboutToSend, "Opening data connection")
+	conn, err := s.Accept()
+	if err != nil {
+		s.Reply(StatusCanNotOpenDataConnection, err.Error())
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	s.m.mu.Lock()
+	s.m.wireBytes += int64(len(data))
+	s.m.mu.Unlock()
+
+	switch {
+	case err != nil:
+	case s.mode == "Z":
+		var r io.ReadCloser
+		if r, err = zlib.NewReader(bytes.NewReader(data)); err == nil {
+			data, err = ioutil.ReadAll(r)
+		}
+	case s.mode == "B":
+		data, err = s.readBlocks(data)
+	}
+	if err != nil {
+		s.Reply(StatusTransfertAborted, err.Error())
+		return nil, false
+	}
+	return data, true
+}
+
+// readBlocks decodes data sent in block mode, acknowledging the restart
+// markers.
+func (s *mockSession) readBlocks(blocks []byte) ([]byte, error) {
+	var data []byte
+	for {
+		if len(blocks) < 3 {
+			return nil, errors.New("missing EOF block")
+		}
+		descriptor, count := blocks[0], int(blocks[1])<<8|int(blocks[2])
+		if len(blocks) < 3+count {
+			return nil, errors.New("truncated block")
+		}
+		block := blocks[3 : 3+count]
+		blocks = blocks[3+count:]
+		if descriptor&16 != 0 {
+			s.Reply(StatusRestartMarker, fmt.Sprintf("MARK %s = %s", block, block))
+			continue
+		}
+		data = append(data, block...)
+		if descriptor&64 != 0 {
+			return data, nil
+		}
+	}
+}
+
+func (s *mockSession) passive() (int, bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.Reply(StatusCanNotOpenDataConnection, err.Error())
+		return 0, false
+	}
+	if s.dataLn != nil {
+		s.dataLn.Close()
+	}
+	s.dataLn = ln
+	return ln.Addr().(*net.TCPAddr).Port, true
+}
+
+func (s *mockSession) serve() {
+	defer s.conn.Close()
+	s.Reply(StatusReady, "Mock FTP server ready")
+
+	for {
+		line, err := s.proto.ReadLine()
+		if err != nil {
+			return
+		}
+		s.m.mu.Lock()
+		s.m.commands = append(s.m.commands, line)
+		s.m.mu.Unlock()
+
+		command, arg := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			command, arg = line[:i], line[i+1:]
+		}
+		command = strings.ToUpper(command)
+		s.m.mu.Lock()
+		h, ok := s.m.handlers[command]
+		s.m.mu.Unlock()
+		if ok {
+			h(s, arg)
+			continue
+		}
+		if !s.handle(command, arg) {
+			return
+		}
+	}
+}
+
+// handle implements the default behaviour of the mock server, it returns
+// false once the control connection must be closed.
+func (s *mockSession) handle(command, arg string) bool {
+	m := s.m
+	switch command {
+	case "FEAT":
+		s.proto.PrintfLine("%d-Features:", StatusSystem)
+		for _, feature := range m.features {
+			s.proto.PrintfLine(" %s", feature)
+		}
+		s.Reply(StatusSystem, "End")
+	case "AUTH":
+		if m.tlsConfig == nil {
+			s.Reply(StatusNotImplemented, "AUTH not supported")
+			break
+		}
+		s.Reply(StatusAuthOK, "AUTH TLS successful")
+		tconn := tls.Server(s.conn, m.tlsConfig)
+		if err := tconn.Handshake(); err != nil {
+			return false
+		}
+		s.conn = tconn
+		s.proto = textproto.NewConn(tconn)
+	case "CCC":
+		tconn, ok := s.conn.(*tls.Conn)
+		if !ok {
+			s.Reply(StatusBadCommand, "Control connection not encrypted")
+			break
+		}
+		s.Reply(StatusCommandOK, "Clearing control channel")
+		// read the close_notify of the client first, as crypto/tls would
+		// otherwise buffer the clear text following it
+		if _, err := io.Copy(ioutil.Discard, tconn); err != nil {
+			return false
+		}
+		tconn.CloseWrite()
+		s.conn = tconn.NetConn()
+		s.conn.SetWriteDeadline(time.Time{})
+		s.proto = textproto.NewConn(s.conn)
+	case "USER":
+		s.Reply(StatusUserOK, "Password required")
+	case "PASS":
+		s.Reply(StatusLoggedIn, "Logged in")
+	case "TYPE", "OPTS", "NOOP", "PBSZ":
+		s.Reply(StatusCommandOK, "OK")
+	case "MODE":
+		if arg == "Z" && !m.hasFeature("MODE Z") {
+			s.Reply(StatusNotImplementedParameter, "Unsupported mode")
+			break
+		}
+		s.mode = arg
+		s.Reply(StatusCommandOK, "Mode set to "+arg)
+	case "PROT":
+		s.prot = arg
+		s.Reply(StatusCommandOK, "Protection level set to "+arg)
+	case "EPSV":
+		if port, ok := s.passive(); ok {
+			s.Reply(StatusExtendedPassiveMode, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		}
+	case "PASV":
+		if port, ok := s.passive(); ok {
+			s.Reply(StatusPassiveMode, fmt.Sprintf("Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256))
+		}
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			s.Reply(StatusBadArguments, err.Error())
+			break
+		}
+		s.rest = offset
+		s.Reply(StatusRequestFilePending, fmt.Sprintf("Restarting at %d. Send STORE or RETRIEVE", offset))
+	case "STOR", "APPE":
+		data, ok := s.Receive()
+		if !ok {
+			break
+		}
+		m.mu.Lock()
+		old := m.files[arg]
+		switch {
+		case command == "APPE":
+			data = append(append([]byte(nil), old...), data...)
+		case s.rest > 0 && s.rest <= int64(len(old)):
+			data = append(append([]byte(nil), old[:s.rest]...), data...)
+		}
+		m.files[arg] = data
+		m.mu.Unlock()
+		s.rest = 0
+		s.Reply(StatusClosingDataConnection, "Transfer complete")
+	case "RETR":
+		data, ok := m.File(arg)
+		if !ok {
+			s.Reply(StatusFileUnavailable, "No such file")
+			break
+		}
+		if s.rest > 0 && s.rest <= int64(len(data)) {
+			data = data[s.rest:]
+		}
+		s.rest = 0
+		s.Send(data)
+	case "LIST", "MLSD", "NLST":
+		m.mu.Lock()
+		lines := m.listings[arg]
+		m.mu.Unlock()
+		var data []byte
+		for _, line := range lines {
+			data = append(data, line+"\r\n"...)
+		}
+		s.Send(data)
+	case "SIZE":
+		data, ok := m.File(arg)
+		if !ok {
+			s.Reply(StatusFileUnavailable, "No such file")
+			break
+		}
+		s.Reply(StatusFile, strconv.Itoa(len(data)))
+	case "MLST":
+		data, ok := m.File(arg)
+		if !ok {
+			s.Reply(StatusFileUnavailable, "No such file")
+			break
+		}
+		s.proto.PrintfLine("%d-Listing %s", StatusRequestedFileActionOK, arg)
+		s.proto.PrintfLine(" type=file;size=%d;modify=20230102030405;media-type=text/plain; %s", len(data), arg)
+		s.Reply(StatusRequestedFileActionOK, "End")
+	case "MDTM":
+		if _, ok := m.File(arg); !ok {
+			s.Reply(StatusFileUnavailable, "No such file")
+			break
+		}
+		s.Reply(StatusFile, time.Now().UTC().Format("20060102150405"))
+	case "DELE":
+		m.mu.Lock()
+		_, ok := m.files[arg]
+		delete(m.files, arg)
+		m.mu.Unlock()
+		if !ok {
+			s.Reply(StatusFileUnavailable, "No such file")
+			break
+		}
+		s.Reply(StatusRequestedFileActionOK, "Deleted")
+	case "RNFR":
+		s.rnfr = arg
+		s.Reply(StatusRequestFilePending, "Ready for destination name")
+	case "RNTO":
+		m.mu.Lock()
+		data, ok := m.files[s.rnfr]
+		if ok {
+			delete(m.files, s.rnfr)
+			m.files[arg] = data
+		}
+		m.mu.Unlock()
+		if !ok {
+			s.Reply(StatusFileUnavailable, "No such file")
+			break
+		}
+		s.Reply(StatusRequestedFileActionOK, "Renamed")
+	case "PORT":
+		fields := strings.Split(arg, ",")
+		if len(fields) != 6 {
+			s.Reply(StatusBadArguments, "Invalid PORT argument")
+			break
+		}
+		p1, _ := strconv.Atoi(fields[4])
+		p2, _ := strconv.Atoi(fields[5])
+		s.active = net.JoinHostPort(strings.Join(fields[:4], "."), strconv.Itoa(p1*256+p2))
+		s.Reply(StatusCommandOK, "PORT command successful")
+	case "EPRT":
+		fields := strings.Split(arg, "|")
+		if !m.hasFeature("EPRT") || len(fields) != 5 {
+			s.Reply(StatusBadCommand, "Command not understood")
+			break
+		}
+		s.active = net.JoinHostPort(fields[2], fields[3])
+		s.Reply(StatusCommandOK, "EPRT command successful")
+	case "CWD":
+		s.cwd = path.Join(s.cwd, arg)
+		if strings.HasPrefix(arg, "/") {
+			s.cwd = path.Clean(arg)
+		}
+		s.Reply(StatusRequestedFileActionOK, "OK")
+	case "CDUP":
+		s.cwd = path.Dir(s.cwd)
+		s.Reply(StatusRequestedFileActionOK, "OK")
+	case "RMD":
+		s.Reply(StatusRequestedFileActionOK, "OK")
+	case "MKD":
+		s.Reply(StatusPathCreated, fmt.Sprintf("%q created", arg))
+	case "PWD":
+		s.Reply(StatusPathCreated, fmt.Sprintf("%q is the current directory", s.cwd))
+	case "REIN":
+		s.Reply(StatusReady, "Ready for new user")
+	case "QUIT":
+		s.Reply(StatusClosing, "Goodbye")
+		return false
+	default:
+		s.Reply(StatusBadCommand, "Command not understood")
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DialNetrc connects to host, which may specify a port, and logs in with the
+// credentials found for it in the .netrc file of the user, like curl and ftp
+// do. The "default" entry is used when host has none. The file is read from
+// the path in the NETRC environment variable, or from the home directory.
+func DialNetrc(host string, opts ...Option) (*Client, error) {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	login, password, found := parseNetrc(f, name)
+	f.Close()
+	if !found {
+		return nil, errors.New("No .netrc entry for " + name)
+	}
+
+	c, err := Dial(Config{Addr: host}.address(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Login(login, password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseNetrc returns the credentials of the entry for machine in a .netrc
+// file, falling back to the default entry.
+func parseNetrc(r io.Reader, machine string) (login, password string, found bool) {
+	type entry struct {
+		login, password string
+	}
+	// target is the entry of the current section, nil when skipped
+	var matched, def, target *entry
+
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		// a macro definition ends with an empty line
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			var value string
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine", "default":
+				if matched != nil {
+					return matched.login, matched.password, true
+				}
+				target = nil
+				if fields[i] == "default" {
+					def = &entry{}
+					target = def
+				} else if i++; value == machine {
+					matched = &entry{}
+					target = matched
+				}
+			case "login":
+				i++
+				if target != nil {
+					target.login = value
+				}
+			case "password":
+				i++
+				if target != nil {
+					target.password = value
+				}
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	switch {
+	case matched != nil:
+		return matched.login, matched.password, true
+	case def != nil:
+		return def.login, def.password, true
+	}
+	return "", "", false
+}
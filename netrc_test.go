@@ -0,0 +1,91 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testNetrc = `machine ftp.example.com login alice password secret
+
+machine mirror.example.com
+	login bob
+	password hunter2
+	account ignored
+
+macdef init
+cd /pub
+binary
+
+default login anonymous password guest@
+`
+
+func TestParseNetrc(t *testing.T) {
+	tests := []struct {
+		machine         string
+		login, password string
+		found           bool
+	}{
+		{"ftp.example.com", "alice", "secret", true},
+		{"mirror.example.com", "bob", "hunter2", true},
+		{"other.example.com", "anonymous", "guest@", true},
+	}
+	for _, test := range tests {
+		login, password, found := parseNetrc(strings.NewReader(testNetrc), test.machine)
+		if login != test.login || password != test.password || found != test.found {
+			t.Errorf("parseNetrc(%s) = %q, %q, %v, expected %q, %q, %v", test.machine,
+				login, password, found, test.login, test.password, test.found)
+		}
+	}
+
+	if _, _, found := parseNetrc(strings.NewReader("machine a login b password c"), "d"); found {
+		t.Error("found an entry without default")
+	}
+}
+
+func TestDialNetrc(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	netrc, err := ioutil.TempFile("", "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(netrc.Name())
+	netrc.WriteString("machine 127.0.0.1 login alice password secret\n")
+	netrc.Close()
+
+	defer os.Setenv("NETRC", os.Getenv("NETRC"))
+	os.Setenv("NETRC", netrc.Name())
+
+	c, err := DialNetrc(mock.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+	if !containsCommand(mock.Commands(), "USER alice") {
+		t.Errorf("expected a login as alice, got %v", mock.Commands())
+	}
+
+	if _, err = DialNetrc("localhost:1"); err == nil {
+		t.Error("expected error for a host without entry, got nil")
+	}
+}
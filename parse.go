@@ -16,6 +16,7 @@ package ftp
 
 import (
 	"errors"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -29,6 +30,10 @@ const (
 	EntryTypeFile EntryType = iota
 	EntryTypeFolder
 	EntryTypeLink
+	// EntryTypeCurrent and EntryTypeParent are the cdir and pdir entries
+	// of a MLSD listing, describing the listed directory and its parent.
+	EntryTypeCurrent
+	EntryTypeParent
 )
 
 // Entry describes a file and is returned by List().
@@ -37,6 +42,16 @@ type Entry struct {
 	Type EntryType
 	Size uint64
 	Time time.Time
+	// Mode holds the type and permission bits of ls-style listings.
+	Mode os.FileMode
+	// MediaType is the MIME type given by the media-type fact of MLSD
+	// listings, if any.
+	MediaType string
+	// Owner and Group are given by the UNIX.ownername and UNIX.groupname
+	// facts of MLSD listings, or else by the numeric UNIX.owner and
+	// UNIX.group facts, if any.
+	Owner string
+	Group string
 }
 
 var (
@@ -48,6 +63,23 @@ var (
 		parseDirListLine,
 	}
 
+	// listMonths maps the abbreviated month names of ls listings, in
+	// English and in the common European locales, to the months.
+	listMonths = map[string]time.Month{
+		"jan": time.January, "janv": time.January, "ene": time.January, "gen": time.January,
+		"feb": time.February, "févr": time.February, "fevr": time.February, "fév": time.February, "fev": time.February,
+		"mar": time.March, "mars": time.March, "mär": time.March, "mrz": time.March, "mrt": time.March,
+		"apr": time.April, "avr": time.April, "abr": time.April,
+		"may": time.May, "mai": time.May, "mag": time.May, "mei": time.May,
+		"jun": time.June, "juin": time.June, "giu": time.June,
+		"jul": time.July, "juil": time.July, "lug": time.July,
+		"aug": time.August, "août": time.August, "aout": time.August, "ago": time.August,
+		"sep": time.September, "sept": time.September, "set": time.September,
+		"oct": time.October, "okt": time.October, "ott": time.October, "out": time.October,
+		"nov": time.November,
+		"dec": time.December, "déc": time.December, "dic": time.December, "dez": time.December,
+	}
+
 	dirTimeFormats = []string{
 		"01-02-06  03:04PM",
 		"2006-01-02  15:04",
@@ -56,55 +88,83 @@ var (
 
 // parseRFC3659ListLine parses the style of directory line defined in RFC 3659.
 func parseRFC3659ListLine(line string) (*Entry, error) {
-	iSemicolon := strings.Index(line, ";")
-	iWhitespace := strings.Index(line, " ")
-
-	if iSemicolon < 0 || iSemicolon > iWhitespace {
-		return nil, errUnsupportedListLine
+	facts, name, err := parseFacts(line)
+	if err != nil {
+		return nil, err
 	}
-
 	e := &Entry{
-		Name: line[iWhitespace+1:],
+		Name: name,
 	}
 
-	for _, field := range strings.Split(line[:iWhitespace-1], ";") {
-		i := strings.Index(field, "=")
-		if i < 1 {
-			return nil, errUnsupportedListLine
-		}
-
-		key := field[:i]
-		value := field[i+1:]
-
+	for key, value := range facts {
 		switch key {
 		case "modify":
-			var err error
 			e.Time, err = time.Parse("20060102150405", value)
 			if err != nil {
 				return nil, err
 			}
 		case "type":
 			switch value {
-			case "dir", "cdir", "pdir":
+			case "dir":
 				e.Type = EntryTypeFolder
+			case "cdir":
+				e.Type = EntryTypeCurrent
+			case "pdir":
+				e.Type = EntryTypeParent
 			case "file":
 				e.Type = EntryTypeFile
 			}
 		case "size":
 			e.setSize(value)
+		case "media-type":
+			e.MediaType = value
 		}
 	}
+	// the names are preferred to the numeric ids
+	if e.Owner = facts["unix.ownername"]; e.Owner == "" {
+		e.Owner = facts["unix.owner"]
+	}
+	if e.Group = facts["unix.groupname"]; e.Group == "" {
+		e.Group = facts["unix.group"]
+	}
 	return e, nil
 }
 
+// parseFacts splits a line in the format defined in RFC 3659 into its facts
+// and the name of the file. The names of the facts, which are case
+// insensitive, are returned in lower case.
+func parseFacts(line string) (map[string]string, string, error) {
+	iSemicolon := strings.Index(line, ";")
+	iWhitespace := strings.Index(line, " ")
+
+	if iSemicolon < 0 || iSemicolon > iWhitespace {
+		return nil, "", errUnsupportedListLine
+	}
+	facts := make(map[string]string)
+
+	for _, field := range strings.Split(line[:iWhitespace-1], ";") {
+		i := strings.Index(field, "=")
+		if i < 1 {
+			return nil, "", errUnsupportedListLine
+		}
+		facts[strings.ToLower(field[:i])] = field[i+1:]
+	}
+	return facts, line[iWhitespace+1:], nil
+}
+
 // parseLsListLine parses a directory line in a format based on the output of
 // the UNIX ls command.
 func parseLsListLine(line string) (*Entry, error) {
 	fields := strings.Fields(line)
 	if len(fields) >= 7 && fields[1] == "folder" && fields[2] == "0" {
+		mode, err := parseMode(fields[0])
+		if err != nil {
+			return nil, err
+		}
 		e := &Entry{
 			Type: EntryTypeFolder,
-			Name: strings.Join(fields[6:], " "),
+			Name: fieldsTail(line, 6),
+			Mode: mode,
 		}
 		if err := e.setTime(fields[3:6]); err != nil {
 			return nil, err
@@ -118,9 +178,14 @@ func parseLsListLine(line string) (*Entry, error) {
 	}
 
 	if fields[1] == "0" {
+		mode, err := parseMode(fields[0])
+		if err != nil {
+			return nil, err
+		}
 		e := &Entry{
 			Type: EntryTypeFile,
-			Name: strings.Join(fields[7:], " "),
+			Name: fieldsTail(line, 7),
+			Mode: mode,
 		}
 
 		if err := e.setSize(fields[2]); err != nil {
@@ -151,14 +216,87 @@ func parseLsListLine(line string) (*Entry, error) {
 	default:
 		return nil, errors.New("Unknown entry type")
 	}
+	mode, err := parseMode(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	e.Mode = mode
 	if err := e.setTime(fields[5:8]); err != nil {
 		return nil, err
 	}
-	e.Name = strings.Join(fields[8:], " ")
+	e.Name = fieldsTail(line, 8)
 
 	return e, nil
 }
 
+// parseMode parses the permissions of an ls-style listing, such as
+// "drwxr-sr-t", into an os.FileMode. A trailing ACL or extended attributes
+// marker ("+", "@" or ".") is ignored.
+func parseMode(perm string) (os.FileMode, error) {
+	if len(perm) < 10 {
+		return 0, errUnsupportedListLine
+	}
+	var mode os.FileMode
+	switch perm[0] {
+	case '-':
+	case 'd':
+		mode = os.ModeDir
+	case 'l':
+		mode = os.ModeSymlink
+	case 'p':
+		mode = os.ModeNamedPipe
+	case 's':
+		mode = os.ModeSocket
+	case 'c':
+		mode = os.ModeDevice | os.ModeCharDevice
+	case 'b':
+		mode = os.ModeDevice
+	default:
+		return 0, errors.New("Unknown entry type")
+	}
+
+	// the execute position also holds the setuid, setgid and sticky bits
+	special := [3]struct {
+		set   byte
+		unset byte
+		bit   os.FileMode
+	}{
+		{'s', 'S', os.ModeSetuid},
+		{'s', 'S', os.ModeSetgid},
+		{'t', 'T', os.ModeSticky},
+	}
+	for i := 0; i < 3; i++ {
+		r, w, x := perm[1+3*i], perm[2+3*i], perm[3+3*i]
+		shift := uint(6 - 3*i)
+		switch r {
+		case 'r':
+			mode |= 4 << shift
+		case '-':
+		default:
+			return 0, errors.New("Invalid permissions: " + perm)
+		}
+		switch w {
+		case 'w':
+			mode |= 2 << shift
+		case '-':
+		default:
+			return 0, errors.New("Invalid permissions: " + perm)
+		}
+		switch x {
+		case 'x':
+			mode |= 1 << shift
+		case special[i].set:
+			mode |= 1<<shift | special[i].bit
+		case special[i].unset:
+			mode |= special[i].bit
+		case '-':
+		default:
+			return 0, errors.New("Invalid permissions: " + perm)
+		}
+	}
+	return mode, nil
+}
+
 // parseDirListLine parses a directory line in a format based on the output of
 // the MS-DOS DIR command.
 func parseDirListLine(line string) (*Entry, error) {
@@ -189,12 +327,17 @@ func parseDirListLine(line string) (*Entry, error) {
 		if space == -1 {
 			return nil, errUnsupportedListLine
 		}
-		e.Size, err = strconv.ParseUint(line[:space], 10, 64)
+		// Some servers group the digits: 1,048,576
+		e.Size, err = strconv.ParseUint(strings.Replace(line[:space], ",", "", -1), 10, 64)
 		if err != nil {
 			return nil, errUnsupportedListLine
 		}
 		e.Type = EntryTypeFile
 		line = line[space:]
+		// and some append the unit: 718 bytes
+		if trimmed := strings.TrimLeft(line, " "); strings.HasPrefix(trimmed, "bytes ") {
+			line = trimmed[len("bytes"):]
+		}
 	}
 
 	e.Name = strings.TrimLeft(line, " ")
@@ -213,21 +356,173 @@ func parseListLine(line string) (*Entry, error) {
 	return nil, errUnsupportedListLine
 }
 
+// fieldsTail returns what follows the n first whitespace separated fields of
+// line, without the single separator, so that names keep their spaces.
+func fieldsTail(line string, n int) string {
+	for i := 0; i < n; i++ {
+		line = strings.TrimLeft(line, " ")
+		end := strings.Index(line, " ")
+		if end == -1 {
+			return ""
+		}
+		line = line[end:]
+	}
+	return strings.TrimPrefix(line, " ")
+}
+
+// parseMdtm parses the YYYYMMDDHHMMSS[.sss] time format of RFC 3659, always
+// expressed in UTC.
+func parseMdtm(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if len(value) < 14 || (len(value) > 14 && value[14] != '.') {
+		return time.Time{}, errors.New("Invalid time format " + value)
+	}
+	if len(value) > 14 {
+		return time.Parse("20060102150405.999999999", value)
+	}
+	return time.Parse("20060102150405", value)
+}
+
+// parseQuotedPath extracts the path quoted in a 257 reply, such as
+// "/pub/it""s" in `"/pub/it""s" created`, where the quotes of the path are
+// doubled as described in RFC 959.
+func parseQuotedPath(msg string) (string, bool) {
+	start := strings.Index(msg, "\"")
+	if start == -1 {
+		return "", false
+	}
+	var b strings.Builder
+	for i := start + 1; i < len(msg); i++ {
+		if msg[i] != '"' {
+			b.WriteByte(msg[i])
+			continue
+		}
+		if i+1 < len(msg) && msg[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), true
+	}
+	return "", false
+}
+
+// parseLeadingInt parses the number starting a reply, such as "1048576" in
+// "1048576 bytes available".
+func parseLeadingInt(msg string) (int64, error) {
+	msg = strings.TrimSpace(msg)
+	end := 0
+	for end < len(msg) && msg[end] >= '0' && msg[end] <= '9' {
+		end++
+	}
+	if end == 0 {
+		return 0, errors.New("Invalid number " + msg)
+	}
+	return strconv.ParseInt(msg[:end], 10, 64)
+}
+
+// parseHelpCommands extracts the command names listed in a HELP reply. The
+// first and last lines of a multiline reply are free text, the names are
+// the upper case words of the other lines.
+func parseHelpCommands(msg string) []string {
+	lines := strings.Split(msg, "\n")
+	if len(lines) > 2 {
+		lines = lines[1 : len(lines)-1]
+	}
+	var commands []string
+	for _, line := range lines {
+		for _, word := range strings.Fields(line) {
+			// unimplemented commands are marked with a star
+			if strings.HasSuffix(word, "*") {
+				continue
+			}
+			if isCommandName(word) {
+				commands = append(commands, word)
+			}
+		}
+	}
+	return commands
+}
+
+// isCommandName reports whether word looks like an FTP command name.
+func isCommandName(word string) bool {
+	if len(word) < 2 {
+		return false
+	}
+	for _, r := range word {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDf parses the output of the df command returned by SITE DF, and
+// returns the number of available bytes of the first filesystem.
+func parseDf(msg string) (int64, error) {
+	lines := strings.Split(msg, "\n")
+
+	for i, line := range lines {
+		header := strings.Fields(line)
+		column, blockSize := -1, int64(1)
+
+		for j, field := range header {
+			switch {
+			case strings.HasPrefix(field, "Avail"):
+				column = j
+			case strings.HasSuffix(field, "-blocks"):
+				size, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSuffix(field, "-blocks"), "K"), 10, 64)
+				if err == nil {
+					if strings.Contains(field, "K-") {
+						size *= 1024
+					}
+					blockSize = size
+				}
+			}
+		}
+		if column == -1 || i+1 == len(lines) {
+			continue
+		}
+		fields := strings.Fields(lines[i+1])
+		if column >= len(fields) {
+			break
+		}
+		avail, err := strconv.ParseInt(fields[column], 10, 64)
+		if err != nil {
+			break
+		}
+		return avail * blockSize, nil
+	}
+	return 0, errors.New("Unsupported SITE DF response format")
+}
+
 func (e *Entry) setSize(str string) (err error) {
 	e.Size, err = strconv.ParseUint(str, 0, 64)
 	return
 }
 
 func (e *Entry) setTime(fields []string) (err error) {
+	month, day := fields[0], fields[1]
+	// some locales put the day first, as in "2. Dez"
+	if _, err := strconv.Atoi(strings.TrimSuffix(month, ".")); err == nil {
+		month, day = day, month
+	}
+	day = strings.TrimSuffix(day, ".")
+	m, ok := listMonths[strings.ToLower(strings.TrimSuffix(month, "."))]
+	if !ok {
+		return errors.New("Invalid month in time string: " + month)
+	}
+	month = m.String()[:3]
+
 	var timeStr string
 	if strings.Contains(fields[2], ":") { // this year
 		thisYear, _, _ := time.Now().Date()
-		timeStr = fields[1] + " " + fields[0] + " " + strconv.Itoa(thisYear)[2:4] + " " + fields[2] + " GMT"
+		timeStr = day + " " + month + " " + strconv.Itoa(thisYear)[2:4] + " " + fields[2] + " GMT"
 	} else { // not this year
 		if len(fields[2]) != 4 {
 			return errors.New("Invalid year format in time string")
 		}
-		timeStr = fields[1] + " " + fields[0] + " " + fields[2][2:4] + " 00:00 GMT"
+		timeStr = day + " " + month + " " + fields[2][2:4] + " 00:00 GMT"
 	}
 	e.Time, err = time.Parse("_2 Jan 06 15:04 MST", timeStr)
 	return
@@ -15,6 +15,8 @@
 package ftp
 
 import (
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -56,8 +58,8 @@ var listTests = []line{
 	{"-rwxrwxrwx   1 noone    nogroup      322 Aug 19  1996 message.ftp", "message.ftp", 322, EntryTypeFile, time.Date(1996, time.August, 19, 0, 0, 0, 0, time.UTC)},
 
 	// RFC3659 format: https://tools.ietf.org/html/rfc3659#section-7
-	{"modify=20150813224845;perm=fle;type=cdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; .", ".", 0, EntryTypeFolder, time.Date(2015, time.August, 13, 22, 48, 45, 0, time.UTC)},
-	{"modify=20150813224845;perm=fle;type=pdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; ..", "..", 0, EntryTypeFolder, time.Date(2015, time.August, 13, 22, 48, 45, 0, time.UTC)},
+	{"modify=20150813224845;perm=fle;type=cdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; .", ".", 0, EntryTypeCurrent, time.Date(2015, time.August, 13, 22, 48, 45, 0, time.UTC)},
+	{"modify=20150813224845;perm=fle;type=pdir;unique=119FBB87U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; ..", "..", 0, EntryTypeParent, time.Date(2015, time.August, 13, 22, 48, 45, 0, time.UTC)},
 	{"modify=20150806235817;perm=fle;type=dir;unique=1B20F360U4;UNIX.group=0;UNIX.mode=0755;UNIX.owner=0; movies", "movies", 0, EntryTypeFolder, time.Date(2015, time.August, 6, 23, 58, 17, 0, time.UTC)},
 	{"modify=20150814172949;perm=flcdmpe;type=dir;unique=85A0C168U4;UNIX.group=0;UNIX.mode=0777;UNIX.owner=0; _upload", "_upload", 0, EntryTypeFolder, time.Date(2015, time.August, 14, 17, 29, 49, 0, time.UTC)},
 	{"modify=20150813175250;perm=adfr;size=951;type=file;unique=119FBB87UE;UNIX.group=0;UNIX.mode=0644;UNIX.owner=0; welcome.msg", "welcome.msg", 951, EntryTypeFile, time.Date(2015, time.August, 13, 17, 52, 50, 0, time.UTC)},
@@ -65,6 +67,9 @@ var listTests = []line{
 	// DOS DIR command output
 	{"08-07-15  07:50PM                  718 Post_PRR_20150901_1166_265118_13049.dat", "Post_PRR_20150901_1166_265118_13049.dat", 718, EntryTypeFile, time.Date(2015, time.August, 7, 19, 50, 0, 0, time.UTC)},
 	{"08-10-15  02:04PM       <DIR>          Billing", "Billing", 0, EntryTypeFolder, time.Date(2015, time.August, 10, 14, 4, 0, 0, time.UTC)},
+	{"08-07-15  07:50PM            1,048,576 archive.zip", "archive.zip", 1048576, EntryTypeFile, time.Date(2015, time.August, 7, 19, 50, 0, 0, time.UTC)},
+	{"08-07-15  07:50PM              1048576 archive.zip", "archive.zip", 1048576, EntryTypeFile, time.Date(2015, time.August, 7, 19, 50, 0, 0, time.UTC)},
+	{"2015-08-07  19:50        1,048,576 bytes archive.zip", "archive.zip", 1048576, EntryTypeFile, time.Date(2015, time.August, 7, 19, 50, 0, 0, time.UTC)},
 
 	// dir and file names that contain multiple spaces
 	{"drwxr-xr-x    3 110      1002            3 Dec 02  2009 spaces   dir   name", "spaces   dir   name", 0, EntryTypeFolder, time.Date(2009, time.December, 2, 0, 0, 0, 0, time.UTC)},
@@ -116,3 +121,213 @@ func TestParseUnsupportedListLine(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		line string
+		mode os.FileMode
+	}{
+		{"-rw-r--r--   1 owner    group          951 Dec 02  2009 file", 0644},
+		{"drwxr-xr-x   3 owner    group            3 Dec 02  2009 dir", os.ModeDir | 0755},
+		{"lrwxrwxrwx   1 root     other            7 Jan 25  2010 bin -> usr/bin", os.ModeSymlink | 0777},
+		{"-rwsr-xr-x   1 root     root         54256 Mar 26  2019 passwd", os.ModeSetuid | 0755},
+		{"-rwSr--r--   1 root     root           100 Mar 26  2019 nosuid", os.ModeSetuid | 0644},
+		{"drwxrws---   2 owner    staff            6 Mar 26  2019 shared", os.ModeDir | os.ModeSetgid | 0770},
+		{"drwxrwxrwt   9 root     root          4096 Mar 26  2019 tmp", os.ModeDir | os.ModeSticky | 0777},
+		{"drwxrwxrwT   9 root     root          4096 Mar 26  2019 tmp", os.ModeDir | os.ModeSticky | 0776},
+		{"-rw-r--r--+  1 owner    group          951 Dec 02  2009 acl", 0644},
+	}
+	for _, test := range tests {
+		entry, err := parseListLine(test.line)
+		if err != nil {
+			t.Errorf("parseListLine(%v) returned err = %v", test.line, err)
+			continue
+		}
+		if entry.Mode != test.mode {
+			t.Errorf("parseListLine(%v).Mode = %v, expected %v", test.line, entry.Mode, test.mode)
+		}
+	}
+
+	if _, err := parseListLine("-rwq------   1 owner    group          951 Dec 02  2009 file"); err == nil {
+		t.Error("expected error for invalid permissions, got nil")
+	}
+}
+
+func TestParseLocaleMonths(t *testing.T) {
+	tests := []struct {
+		line  string
+		month time.Month
+		day   int
+	}{
+		{"-rw-r--r--   1 owner    group          951 déc.  2  2009 fichier", time.December, 2},
+		{"-rw-r--r--   1 owner    group          951 janv. 15  2009 fichier", time.January, 15},
+		{"-rw-r--r--   1 owner    group          951 ene  7  2009 archivo", time.January, 7},
+		{"-rw-r--r--   1 owner    group          951 dic 24  2009 archivo", time.December, 24},
+		{"-rw-r--r--   1 owner    group          951 2. Dez  2009 datei", time.December, 2},
+		{"-rw-r--r--   1 owner    group          951 mag 12  2009 file", time.May, 12},
+	}
+	for _, test := range tests {
+		entry, err := parseListLine(test.line)
+		if err != nil {
+			t.Errorf("parseListLine(%v) returned err = %v", test.line, err)
+			continue
+		}
+		if _, month, day := entry.Time.Date(); month != test.month || day != test.day || entry.Time.Year() != 2009 {
+			t.Errorf("parseListLine(%v).Time = %v, expected %v %d, 2009", test.line, entry.Time, test.month, test.day)
+		}
+	}
+}
+
+func TestParseMediaType(t *testing.T) {
+	entry, err := parseListLine("modify=20150813175250;Media-Type=application/pdf;size=951;type=file; report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.MediaType != "application/pdf" {
+		t.Errorf("media type %q, expected application/pdf", entry.MediaType)
+	}
+
+	entry, err = parseListLine("modify=20150813175250;size=951;type=file; welcome.msg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.MediaType != "" {
+		t.Errorf("media type %q, expected none", entry.MediaType)
+	}
+}
+
+func TestParseOwnerGroup(t *testing.T) {
+	tests := []struct {
+		line  string
+		owner string
+		group string
+	}{
+		{"modify=20150813175250;size=951;type=file;UNIX.owner=1000;UNIX.ownername=alice;UNIX.group=20;UNIX.groupname=staff; a.txt", "alice", "staff"},
+		{"modify=20150813175250;size=951;type=file;UNIX.owner=1000;UNIX.group=20; b.txt", "1000", "20"},
+		{"modify=20150813175250;size=951;type=file; c.txt", "", ""},
+	}
+	for _, test := range tests {
+		entry, err := parseListLine(test.line)
+		if err != nil {
+			t.Errorf("parseListLine(%q) returned err = %v", test.line, err)
+			continue
+		}
+		if entry.Owner != test.owner || entry.Group != test.group {
+			t.Errorf("parseListLine(%q) owner %q, group %q, want %q, %q", test.line, entry.Owner, entry.Group, test.owner, test.group)
+		}
+	}
+}
+
+func TestParseDf(t *testing.T) {
+	tests := []struct {
+		msg   string
+		avail int64
+	}{
+		{"Filesystem     1K-blocks     Used Available Use% Mounted on\n/dev/sda1       41152736 12327948  26711636  32% /", 26711636 * 1024},
+		{"Filesystem 512-blocks Used Avail Capacity Mounted on\n/dev/ada0p2 40583424 9874520 27462232 26% /", 27462232 * 512},
+		{"Status of the disk:\nFilesystem Size Used Avail\n/dev/sdb1 100 40 60", 60},
+	}
+	for _, test := range tests {
+		avail, err := parseDf(test.msg)
+		if err != nil {
+			t.Errorf("parseDf(%q) returned err = %v", test.msg, err)
+			continue
+		}
+		if avail != test.avail {
+			t.Errorf("parseDf(%q) = %d, want %d", test.msg, avail, test.avail)
+		}
+	}
+
+	if _, err := parseDf("Disk is fine"); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestParseHelpCommands(t *testing.T) {
+	tests := []struct {
+		msg      string
+		commands []string
+	}{
+		// proftpd
+		{"The following SITE commands are recognized (* =>'s unimplemented)\n CHMOD\n CHGRP\n HELP\nDirect comments to root@localhost", []string{"CHMOD", "CHGRP", "HELP"}},
+		// pure-ftpd
+		{"The following SITE commands are recognized\n ALIAS\n CHMOD\n IDLE\n UTIME\nPure-FTPd - http://pureftpd.org/", []string{"ALIAS", "CHMOD", "IDLE", "UTIME"}},
+		// vsftpd
+		{"CHMOD UMASK HELP", []string{"CHMOD", "UMASK", "HELP"}},
+		{"The following commands are recognized\n CWD     XCWD    CDUP*   SIZE\nHelp OK", []string{"CWD", "XCWD", "SIZE"}},
+	}
+	for _, test := range tests {
+		commands := parseHelpCommands(test.msg)
+		if strings.Join(commands, ",") != strings.Join(test.commands, ",") {
+			t.Errorf("parseHelpCommands(%q) = %v, want %v", test.msg, commands, test.commands)
+		}
+	}
+}
+
+func TestParseServerSoftware(t *testing.T) {
+	tests := []struct {
+		banner  string
+		name    string
+		version string
+	}{
+		{"ProFTPD 1.3.6 Server (Debian) [::ffff:10.0.0.1]", "ProFTPD", "1.3.6"},
+		{"ProFTPD Server (ProFTPD) [10.0.0.1]", "ProFTPD", ""},
+		{"(vsFTPd 3.0.3)", "vsFTPd", "3.0.3"},
+		{"---------- Welcome to Pure-FTPd [privsep] [TLS] ----------\nYou are user number 1 of 50 allowed.", "Pure-FTPd", ""},
+		{"FileZilla Server version 0.9.41 beta", "FileZilla Server", "0.9.41"},
+		{"FileZilla Server 1.5.1", "FileZilla Server", "1.5.1"},
+		{"Microsoft FTP Service", "Microsoft FTP Service", ""},
+		{"Serv-U FTP Server v15.1 ready...", "Serv-U", "15.1"},
+		{"ftp.example.com FTP server (Version wu-2.6.2(1) Mon Dec 3 15:33:07 GMT 2001) ready.", "wu-ftpd", "2.6.2"},
+		{"Mock FTP server ready", "", ""},
+	}
+	for _, test := range tests {
+		name, version := parseServerSoftware(test.banner)
+		if name != test.name || version != test.version {
+			t.Errorf("parseServerSoftware(%q) = %q, %q, want %q, %q", test.banner, name, version, test.name, test.version)
+		}
+	}
+}
+
+func TestParseQuotedPath(t *testing.T) {
+	tests := []struct {
+		msg  string
+		path string
+		ok   bool
+	}{
+		{`"/pub/dir" created`, "/pub/dir", true},
+		{`"/pub/it""s" created`, "/pub/it\"s", true},
+		{`"/home/user" is the current directory`, "/home/user", true},
+		{`MKD command successful "/a" "b"`, "/a", true},
+		{`Directory created`, "", false},
+		{`"/unterminated`, "", false},
+	}
+	for _, test := range tests {
+		path, ok := parseQuotedPath(test.msg)
+		if path != test.path || ok != test.ok {
+			t.Errorf("parseQuotedPath(%q) = %q, %v, want %q, %v", test.msg, path, ok, test.path, test.ok)
+		}
+	}
+}
+
+func TestParseMdtm(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"20230102030405", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"20230102030405.5", time.Date(2023, 1, 2, 3, 4, 5, 500000000, time.UTC)},
+		{"20230102030405.123\r", time.Date(2023, 1, 2, 3, 4, 5, 123000000, time.UTC)},
+	}
+	for _, test := range tests {
+		got, err := parseMdtm(test.value)
+		if err != nil || !got.Equal(test.expected) || got.Location() != time.UTC {
+			t.Errorf("parseMdtm(%q) = %v, %v, want %v", test.value, got, err, test.expected)
+		}
+	}
+	for _, value := range []string{"2023010203", "20230102030405Z", "yesterday"} {
+		if _, err := parseMdtm(value); err == nil {
+			t.Errorf("parseMdtm(%q): expected an error", value)
+		}
+	}
+}
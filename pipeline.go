@@ -0,0 +1,419 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DownloadError is returned by ListAndDownload when some files could not be
+// downloaded.
+type DownloadError struct {
+	// Downloaded is the number of files downloaded successfully.
+	Downloaded int
+	// Failed maps the names of the files which were not downloaded to the
+	// reason why.
+	Failed map[string]error
+}
+
+func (e *DownloadError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("Failed to download %d of %d files, %s: %v",
+		len(e.Failed), len(e.Failed)+e.Downloaded, names[0], e.Failed[names[0]])
+}
+
+// ListAndDownload downloads the files of the directory remoteDir into
+// localDir, which must exist. One connection lists remoteDir while workers
+// connections download the files as they are listed. The subdirectories
+// are skipped. Fewer connections are used when the server limits them, see
+// ConnectionLimit.
+//
+// A *DownloadError is returned when some files could not be downloaded.
+func (cfg Config) ListAndDownload(remoteDir, localDir string, workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("Invalid number of workers: %d", workers)
+	}
+	listers, err := cfg.dialWorkers(1, 0)
+	if err != nil {
+		return err
+	}
+	lister := listers[0]
+	defer lister.Close()
+
+	conns, err := cfg.dialWorkers(workers, 1)
+	if err != nil {
+		return err
+	}
+	defer closeAll(conns)
+
+	var mu sync.Mutex
+	result := &DownloadError{Failed: make(map[string]error)}
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for name := range names {
+				err := c.Download(path.Join(remoteDir, name), filepath.Join(localDir, name))
+				mu.Lock()
+				if err != nil {
+					result.Failed[name] = err
+				} else {
+					result.Downloaded++
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+
+	err = lister.ListCallback(remoteDir, func(entry *Entry) error {
+		if entry.Type != EntryTypeFile {
+			return nil
+		}
+		// a name from the server must not escape localDir
+		if path.Base(entry.Name) != entry.Name || filepath.Base(entry.Name) != entry.Name {
+			mu.Lock()
+			result.Failed[entry.Name] = errors.New("Invalid file name")
+			mu.Unlock()
+			return nil
+		}
+		names <- entry.Name
+		return nil
+	})
+	close(names)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// ListError is returned by ListMany when some directories could not be
+// listed.
+type ListError struct {
+	// Failed maps the paths of the directories which were not listed to
+	// the reason why.
+	Failed map[string]error
+}
+
+func (e *ListError) Error() string {
+	paths := make([]string, 0, len(e.Failed))
+	for p := range e.Failed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf("Failed to list %d directories, %s: %v", len(e.Failed), paths[0], e.Failed[paths[0]])
+}
+
+// ListMany lists the directories at paths over workers connections, and
+// returns their entries by path. Fewer connections are used when the server
+// limits them, see ConnectionLimit.
+//
+// A *ListError is returned along with the listings of the other directories
+// when some directories could not be listed.
+func (cfg Config) ListMany(paths []string, workers int) (map[string][]*Entry, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("Invalid number of workers: %d", workers)
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	conns, err := cfg.dialWorkers(workers, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAll(conns)
+
+	var mu sync.Mutex
+	listings := make(map[string][]*Entry, len(paths))
+	result := &ListError{Failed: make(map[string]error)}
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for p := range queue {
+				entries, err := c.List(p)
+				mu.Lock()
+				if err != nil {
+					result.Failed[p] = err
+				} else {
+					listings[p] = entries
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+	for _, p := range paths {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(result.Failed) > 0 {
+		return listings, result
+	}
+	return listings, nil
+}
+
+// RemoveError is returned by RemoveMany when some files could not be
+// removed.
+type RemoveError struct {
+	// Failed maps the paths of the files which were not removed to the
+	// reason why.
+	Failed map[string]error
+}
+
+func (e *RemoveError) Error() string {
+	paths := make([]string, 0, len(e.Failed))
+	for p := range e.Failed {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf("Failed to remove %d files, %s: %v", len(e.Failed), paths[0], e.Failed[paths[0]])
+}
+
+// RemoveMany removes the files at paths over workers connections, and
+// returns the number of files removed. The files which are already gone,
+// for which the DELE FTP command fails with a 550 reply and a SIZE FTP
+// command with another one, are skipped. Fewer connections are used when the
+// server limits them, see ConnectionLimit.
+//
+// A *RemoveError is returned when some files could not be removed.
+func (cfg Config) RemoveMany(paths []string, workers int) (int, error) {
+	if workers < 1 {
+		return 0, fmt.Errorf("Invalid number of workers: %d", workers)
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+	conns, err := cfg.dialWorkers(workers, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer closeAll(conns)
+
+	var mu sync.Mutex
+	deleted := 0
+	result := &RemoveError{Failed: make(map[string]error)}
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for p := range queue {
+				err := c.Remove(p)
+				if fileUnavailable(err) {
+					if _, sizeErr := c.FileSize(p); fileUnavailable(sizeErr) {
+						continue
+					}
+				}
+				mu.Lock()
+				if err != nil {
+					result.Failed[p] = err
+				} else {
+					deleted++
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+	for _, p := range paths {
+		queue <- p
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(result.Failed) > 0 {
+		return deleted, result
+	}
+	return deleted, nil
+}
+
+// Download retrieves the remote file into the local file. The data is
+// written to a temporary file with a random name in the directory of local,
+// which is renamed to local once the transfer completed, so that local never
+// holds a partial download. The temporary file is removed when the transfer
+// fails.
+func (c *Client) Download(remote, local string) error {
+	return c.download(remote, local, nil, nil)
+}
+
+// download retrieves the remote file into the local file through a
+// temporary file. The data is also written to w unless it is nil, and the
+// download fails unless verify, called after the transfer, returns nil.
+func (c *Client) download(remote, local string, w io.Writer, verify func() error) error {
+	r, err := c.Retr(remote)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := createTemp(local)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	dst := io.Writer(f)
+	if w != nil {
+		dst = io.MultiWriter(f, w)
+	}
+	_, err = c.copy(dst, r)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err2 := r.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && verify != nil {
+		err = verify()
+	}
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// createTemp creates a temporary file with a random name next to local. Its
+// mode is the one os.Create gives, as the file is renamed to local, where
+// ioutil.TempFile would restrict it to the owner.
+func createTemp(local string) (*os.File, error) {
+	var random [8]byte
+	for i := 0; ; i++ {
+		if _, err := rand.Read(random[:]); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(filepath.Dir(local), "."+filepath.Base(local)+"."+hex.EncodeToString(random[:])+".tmp")
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// SetCaseInsensitive tells the client that the server is case-insensitive,
+// such as most Windows ones. UploadDir then fails before uploading anything
+// when names only differ by their case, as they would overwrite each other on
+// the server, see CheckCaseCollisions.
+func (c *Client) SetCaseInsensitive(enable bool) {
+	c.caseInsensitive = enable
+}
+
+// UploadDir copies the tree below localDir into remoteDir, creating the
+// remote directories as needed. The upload stops at the first error, which
+// is returned.
+func (c *Client) UploadDir(localDir, remoteDir string) error {
+	// the paths relative to localDir, with slashes
+	var dirs, files []string
+	err := filepath.Walk(localDir, func(local string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, local)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			dirs = append(dirs, rel)
+		} else if info.Mode().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if c.caseInsensitive {
+		if err = CheckCaseCollisions(append(append([]string(nil), dirs...), files...)); err != nil {
+			return err
+		}
+	}
+
+	if err = c.MakeDirAll(remoteDir); err != nil {
+		return err
+	}
+	// filepath.Walk lists the parents before their children
+	for _, dir := range dirs {
+		if err = c.MakeDirAll(path.Join(remoteDir, dir)); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if err = c.uploadFile(filepath.Join(localDir, filepath.FromSlash(file)), path.Join(remoteDir, file)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads the local file to the remote path.
+func (c *Client) uploadFile(local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Stor(remote, f)
+}
+
+// CheckCaseCollisions returns an error listing the paths which only differ by
+// their case, such as "README" and "readme". Uploaded to a case-insensitive
+// server, such as most Windows ones, they would overwrite each other:
+// UploadDir checks its paths with it after SetCaseInsensitive.
+func CheckCaseCollisions(names []string) error {
+	groups := make(map[string][]string)
+	for _, name := range names {
+		key := strings.ToLower(name)
+		groups[key] = append(groups[key], name)
+	}
+	var collisions []string
+	for _, group := range groups {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, strings.Join(group, ", "))
+		}
+	}
+	if collisions == nil {
+		return nil
+	}
+	sort.Strings(collisions)
+	return errors.New("Names colliding on a case-insensitive server: " + strings.Join(collisions, "; "))
+}
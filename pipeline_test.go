@@ -0,0 +1,370 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListAndDownload(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetListing("/pub",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 releases",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 a.txt",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 b.txt",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 c.txt",
+		"-rw-r--r--    1 110      1002           14 Dec 02  2009 missing.txt",
+	)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		mock.SetFile("/pub/"+name, []byte(testData+name))
+	}
+
+	dir, err := ioutil.TempDir("", "ftp-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous"}
+	err = cfg.ListAndDownload("/pub", dir, 2)
+	downloadErr, ok := err.(*DownloadError)
+	if !ok {
+		t.Fatalf("got error %v, expected a *DownloadError", err)
+	}
+	if downloadErr.Downloaded != 3 || len(downloadErr.Failed) != 1 || downloadErr.Failed["missing.txt"] == nil {
+		t.Errorf("unexpected result: %+v", downloadErr)
+	}
+
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if string(data) != testData+name {
+			t.Errorf("local file %s is %q, expected %q", name, data, testData+name)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "releases")); !os.IsNotExist(err) {
+		t.Error("the subdirectory was downloaded")
+	}
+}
+
+func TestCheckCaseCollisions(t *testing.T) {
+	if err := CheckCaseCollisions([]string{"README", "main.go", "docs/readme"}); err != nil {
+		t.Error(err)
+	}
+	err := CheckCaseCollisions([]string{"README", "b.txt", "readme", "A.txt", "a.TXT", "c"})
+	expected := "Names colliding on a case-insensitive server: A.txt, a.TXT; README, readme"
+	if err == nil || err.Error() != expected {
+		t.Errorf("got error %v, expected %q", err, expected)
+	}
+}
+
+func TestUploadDir(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	dir, err := ioutil.TempDir("", "ftp-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"README", filepath.Join("sub", "b.txt")} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(testData), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.UploadDir(dir, "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dst/README", "/dst/sub/b.txt"} {
+		if data, _ := mock.File(name); string(data) != testData {
+			t.Errorf("uploaded %q to %s, expected %q", data, name, testData)
+		}
+	}
+	if !containsCommand(mock.Commands(), "MKD /dst/sub") {
+		t.Errorf("expected the subdirectory to be created, got %v", mock.Commands())
+	}
+
+	// names colliding on a case-insensitive server are rejected up front
+	if err = ioutil.WriteFile(filepath.Join(dir, "readme"), []byte(testData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 3 {
+		t.Skip("case-insensitive local file system")
+	}
+	c.SetCaseInsensitive(true)
+	sent := len(mock.Commands())
+	if err = c.UploadDir(dir, "/dst"); err == nil || !strings.Contains(err.Error(), "README, readme") {
+		t.Errorf("got error %v, expected the colliding names", err)
+	}
+	if commands := mock.Commands(); len(commands) != sent {
+		t.Errorf("got commands %v despite the collision", commands[sent:])
+	}
+}
+
+func TestListMany(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	paths := []string{"/a", "/b", "/c", "/denied"}
+	for _, p := range paths[:3] {
+		mock.SetListing(p, "-rw-r--r--    1 110      1002          951 Dec 02  2009 file"+p[1:])
+	}
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		if arg == "/denied" {
+			s.Reply(StatusFileUnavailable, "Permission denied")
+			return
+		}
+		s.handle("LIST", arg)
+	})
+
+	cfg := Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous"}
+	listings, err := cfg.ListMany(paths, 2)
+	lerr, ok := err.(*ListError)
+	if !ok {
+		t.Fatalf("got error %v, expected a *ListError", err)
+	}
+	if len(lerr.Failed) != 1 || lerr.Failed["/denied"] == nil {
+		t.Errorf("got failures %v", lerr.Failed)
+	}
+	if len(listings) != 3 {
+		t.Errorf("got %d listings, expected 3", len(listings))
+	}
+	for _, p := range paths[:3] {
+		if entries := listings[p]; len(entries) != 1 || entries[0].Name != "file"+p[1:] {
+			t.Errorf("got entries %v for %s", entries, p)
+		}
+	}
+}
+
+func TestListManyConnectionLimit(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	paths := []string{"/a", "/b", "/c", "/d"}
+	for _, p := range paths {
+		mock.SetListing(p, "-rw-r--r--    1 110      1002          951 Dec 02  2009 file"+p[1:])
+	}
+	var mu sync.Mutex
+	sessions := 0
+	mock.Handle("USER", func(s *mockSession, arg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sessions == 2 {
+			s.Reply(StatusNotLoggedIn, "Too many connections (2) from this user")
+			return
+		}
+		sessions++
+		s.handle("USER", arg)
+	})
+	mock.Handle("QUIT", func(s *mockSession, arg string) {
+		mu.Lock()
+		sessions--
+		mu.Unlock()
+		s.handle("QUIT", arg)
+	})
+
+	cfg := Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous"}
+	if limit := cfg.ConnectionLimit(); limit != 0 {
+		t.Errorf("ConnectionLimit = %d before any rejection, expected 0", limit)
+	}
+	listings, err := cfg.ListMany(paths, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 4 {
+		t.Errorf("got %d listings, expected 4", len(listings))
+	}
+	if limit := cfg.ConnectionLimit(); limit != 2 {
+		t.Errorf("ConnectionLimit = %d, expected 2", limit)
+	}
+
+	// the limit is forgotten once expired
+	defer func(ttl time.Duration) { connLimitTTL = ttl }(connLimitTTL)
+	connLimitTTL = 0
+	cfg.setConnectionLimit(2)
+	if limit := cfg.ConnectionLimit(); limit != 0 {
+		t.Errorf("ConnectionLimit = %d after expiry, expected 0", limit)
+	}
+}
+
+func TestListManyTLS(t *testing.T) {
+	mock, _ := newFtpMockTLS(t)
+	defer mock.Close()
+	paths := []string{"/a", "/b"}
+	for _, p := range paths {
+		mock.SetListing(p, "-rw-r--r--    1 110      1002          951 Dec 02  2009 file"+p[1:])
+	}
+
+	cfg := Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous", TLS: true, SkipVerify: true}
+	c, err := cfg.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.Config.TLS || !c.Config.SkipVerify {
+		t.Errorf("got config %+v after login, expected the TLS settings to be kept", c.Config)
+	}
+	listings, err := c.ListMany(paths, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 2 {
+		t.Errorf("got %d listings, expected 2", len(listings))
+	}
+	// every session, the workers included, must negotiate AUTH TLS
+	auth, users := 0, 0
+	for _, cmd := range mock.Commands() {
+		switch {
+		case cmd == "AUTH TLS":
+			auth++
+		case strings.HasPrefix(cmd, "USER "):
+			users++
+		}
+	}
+	if users < 2 || auth != users {
+		t.Errorf("got %d AUTH TLS for %d logins, expected one per session", auth, users)
+	}
+}
+
+func TestDownloadAtomic(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	mock.SetFile("/file", []byte(testData))
+	mock.Handle("RETR", func(s *mockSession, arg string) {
+		if arg != "/broken" {
+			s.handle("RETR", arg)
+			return
+		}
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(testData[:5]))
+		conn.Close()
+		s.Reply(StatusTransfertAborted, "Connection closed; transfer aborted")
+	})
+
+	dir, err := ioutil.TempDir("", "ftp-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a local file named like a temporary one is left alone
+	other := filepath.Join(dir, "file.tmp")
+	if err = ioutil.WriteFile(other, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "file")
+	if err = c.Download("/file", local); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(local); err != nil || string(data) != testData {
+		t.Errorf("got %q, %v, expected %q", data, err, testData)
+	}
+	if data, err := ioutil.ReadFile(other); err != nil || string(data) != "other" {
+		t.Errorf("got %q, %v in %s, expected it unchanged", data, err, other)
+	}
+	// the download gets the mode of the files created by os.Create
+	created, err := os.Create(filepath.Join(dir, "created"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created.Close()
+	want, err := os.Stat(created.Name())
+	os.Remove(created.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != want.Mode() {
+		t.Errorf("got mode %v, expected %v", info.Mode(), want.Mode())
+	}
+
+	broken := filepath.Join(dir, "broken")
+	if err = c.Download("/broken", broken); err == nil {
+		t.Fatal("expected an error for a broken transfer")
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != local || names[1] != other {
+		t.Errorf("got files %v, expected only %s and %s", names, local, other)
+	}
+}
+
+func TestRemoveMany(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+	paths := []string{"/a", "/b", "/c", "/d", "/gone", "/locked"}
+	for _, p := range paths {
+		if p != "/gone" {
+			mock.SetFile(p, []byte(testData))
+		}
+	}
+	mock.Handle("DELE", func(s *mockSession, arg string) {
+		if arg == "/locked" {
+			s.Reply(StatusFileUnavailable, "Permission denied")
+			return
+		}
+		s.handle("DELE", arg)
+	})
+
+	cfg := Config{Addr: mock.Addr(), User: "anonymous", Pass: "anonymous"}
+	deleted, err := cfg.RemoveMany(paths, 3)
+	rerr, ok := err.(*RemoveError)
+	if !ok {
+		t.Fatalf("got error %v, expected a *RemoveError", err)
+	}
+	if len(rerr.Failed) != 1 || rerr.Failed["/locked"] == nil {
+		t.Errorf("got failures %v", rerr.Failed)
+	}
+	if deleted != 4 {
+		t.Errorf("deleted %d files, expected 4", deleted)
+	}
+	for _, p := range paths[:4] {
+		if _, ok := mock.File(p); ok {
+			t.Errorf("%s was not removed", p)
+		}
+	}
+}
@@ -15,26 +15,197 @@
 package ftp
 
 import (
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/textproto"
+	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 // response represent a data-connection
 type response struct {
-	conn net.Conn
-	c    *client
+	conn      net.Conn
+	c         *Client
+	keepAlive *keepAlive
+
+	// path is set for file downloads, which are reported to the event
+	// handler along with the number of bytes read and the start time.
+	path  string
+	n     int64
+	start time.Time
+	// size is the expected size of the data, -1 when unknown.
+	size int64
+
+	closed bool
+}
+
+// newResponse returns the reader of a data connection. ErrResponseNotClosed
+// is reported to the event handler, from the finalizer goroutine, when it is
+// garbage collected without being closed, as the control connection is then
+// left waiting for the end of the transfer.
+func (c *Client) newResponse(conn net.Conn) *response {
+	r := &response{conn: conn, c: c, size: -1}
+	runtime.SetFinalizer(r, func(r *response) {
+		r.c.failed("close", ErrResponseNotClosed)
+	})
+	return r
 }
 
 // Read implements the io.Reader interface on a FTP data connection.
 func (r *response) Read(buf []byte) (int, error) {
-	return r.conn.Read(buf)
+	n, err := r.conn.Read(buf)
+	atomic.AddInt64(&r.c.stats.downloaded, int64(n))
+	r.n += int64(n)
+	return n, err
 }
 
 // Close implements the io.Closer interface on a FTP data connection.
+//
+// The data which was not read yet is drained before reading the final reply
+// of the server, so that closing a partially read response leaves the
+// control connection in a usable state, and that no data is lost when the
+// server sends its final reply before the end of the data. Close can be
+// called several times.
 func (r *response) Close() error {
-	err := r.conn.Close()
-	_, _, err2 := r.c.conn.ReadResponse(StatusClosingDataConnection)
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+
+	drained, err := io.Copy(ioutil.Discard, r.conn)
+	if err2 := r.conn.Close(); err == nil {
+		err = err2
+	}
+	err2 := r.c.transferResponse(r.keepAlive.Stop())
 	if err2 != nil {
 		err = err2
 	}
+	if err == nil && r.size >= 0 && r.n+drained != r.size {
+		err = ErrTransferTypeMismatch
+	}
+	if r.path != "" {
+		if err != nil {
+			r.c.failed("retr", err)
+		} else {
+			r.c.event(Event{Type: EventTransferComplete, Path: r.path, Bytes: r.n, Duration: time.Since(r.start)})
+		}
+	}
+	return err
+}
+
+// abort closes the data connection without draining it and interrupts the
+// transfer with an ABOR FTP command. Both the reply of the transfer, which
+// may have completed or not, and the one of ABOR are read.
+func (r *response) abort() error {
+	r.closed = true
+	runtime.SetFinalizer(r, nil)
+	r.conn.Close()
+
+	noops := r.keepAlive.Stop()
+	if _, err := r.c.conn.Cmd("ABOR"); err != nil {
+		return err
+	}
+	if err := r.c.transferResponse(noops); err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			return err
+		}
+	}
+	_, _, err := r.c.conn.ReadResponse(2)
+	return err
+}
+
+// retryReader is the reader returned by RetrRetry, which resumes the broken
+// transfers.
+type retryReader struct {
+	c        *Client
+	path     string
+	r        io.ReadCloser
+	offset   uint64
+	attempts int
+	err      error
+}
+
+// Read implements the io.Reader interface, resuming the transfer when the
+// data connection breaks.
+func (rr *retryReader) Read(buf []byte) (int, error) {
+	for {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		n, err := rr.r.Read(buf)
+		rr.offset += uint64(n)
+		if err == nil {
+			return n, nil
+		}
+		// the final reply tells a complete transfer from a broken one
+		closeErr := rr.r.Close()
+		if err == io.EOF && closeErr == nil {
+			rr.err = io.EOF
+			return n, io.EOF
+		}
+		if closeErr != nil {
+			err = closeErr
+		}
+		if err = rr.resume(err); err != nil {
+			rr.err = err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume reopens the transfer after it failed with err, from the bytes
+// already read.
+func (rr *retryReader) resume(err error) error {
+	c := rr.c
+	for ; rr.attempts > 0; rr.attempts-- {
+		var protoErr *textproto.Error
+		ok := errors.As(err, &protoErr)
+		if ok && protoErr.Code >= 500 || errors.Is(err, ErrPathTooLong) {
+			return err
+		} else if !ok {
+			if err = c.reconnect(); err != nil {
+				continue
+			}
+			if err = c.restoreSession(c.User, c.Pass); err != nil {
+				continue
+			}
+		}
+		var r io.ReadCloser
+		if r, err = c.RetrFrom(rr.path, rr.offset); err == nil {
+			rr.attempts--
+			rr.r = r
+			return nil
+		}
+	}
+	return err
+}
+
+// Close implements the io.Closer interface, closing the current transfer.
+func (rr *retryReader) Close() error {
+	return rr.r.Close()
+}
+
+// transformReader is the reader returned by RetrTransform.
+type transformReader struct {
+	io.Reader
+	r io.ReadCloser
+}
+
+// Close implements the io.Closer interface, closing the transforming reader
+// then the transfer. The error of the transfer prevails.
+func (tr *transformReader) Close() error {
+	var err error
+	if closer, ok := tr.Reader.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if err2 := tr.r.Close(); err2 != nil {
+		err = err2
+	}
 	return err
 }
@@ -0,0 +1,65 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats describes the activity of a connection, as returned by Stats().
+type Stats struct {
+	CommandsSent    int64
+	BytesUploaded   int64
+	BytesDownloaded int64
+	// AvgRTT is the average time between sending a command on the control
+	// connection and reading its reply.
+	AvgRTT time.Duration
+}
+
+// connStats holds the counters of a connection. They are updated atomically
+// so that Stats can be called while the connection is in use.
+type connStats struct {
+	commands   int64
+	uploaded   int64
+	downloaded int64
+	replies    int64
+	rtt        int64
+}
+
+// Stats returns a snapshot of the counters of the connection. It is safe to
+// call it concurrently with the other methods.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		CommandsSent:    atomic.LoadInt64(&c.stats.commands),
+		BytesUploaded:   atomic.LoadInt64(&c.stats.uploaded),
+		BytesDownloaded: atomic.LoadInt64(&c.stats.downloaded),
+	}
+	if replies := atomic.LoadInt64(&c.stats.replies); replies > 0 {
+		s.AvgRTT = time.Duration(atomic.LoadInt64(&c.stats.rtt) / replies)
+	}
+	return s
+}
+
+// sent accounts for a command sent on the control connection.
+func (s *connStats) sent() {
+	atomic.AddInt64(&s.commands, 1)
+}
+
+// replied accounts for the round trip of a command.
+func (s *connStats) replied(rtt time.Duration) {
+	atomic.AddInt64(&s.replies, 1)
+	atomic.AddInt64(&s.rtt, int64(rtt))
+}
@@ -0,0 +1,233 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// ProtLevel describes the protection level of the data connections.
+type ProtLevel string
+
+// The protection levels defined in RFC 4217
+const (
+	ProtClear   ProtLevel = "C"
+	ProtPrivate ProtLevel = "P"
+)
+
+// DialTLS initializes an explicit FTPS connection to the specified ftp server
+// address: the control connection is upgraded to TLS with an AUTH TLS command
+// before anything else is exchanged.
+//
+// Login protects the data connections with TLS when the server advertises
+// the PBSZ and PROT commands, see SetDataProtection to change it.
+func DialTLS(addr string, tlsConfig *tls.Config, timeout time.Duration, opts ...Option) (*Client, error) {
+	return dialTLSContext(context.Background(), addr, tlsConfig, timeout, opts)
+}
+
+// dialTLSContext initializes an explicit FTPS connection within ctx.
+func dialTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config, timeout time.Duration, opts []Option) (*Client, error) {
+	c, err := dial(ctx, addr, timeout, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = c.withContext(ctx, func() error {
+		return c.authTLS(addr, tlsConfig)
+	})
+	if err != nil {
+		c.Close()
+		return nil, c.failed("dial", err)
+	}
+	err = c.withContext(ctx, c.setup)
+	if err != nil {
+		c.Close()
+		return nil, c.failed("dial", err)
+	}
+	return c, nil
+}
+
+// authTLS issues an AUTH TLS FTP command and upgrades the control connection.
+// AUTH TLS is described in RFC 4217
+func (c *Client) authTLS(addr string, tlsConfig *tls.Config) error {
+	_, _, err := c.cmd(StatusAuthOK, "AUTH TLS")
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	// Data connections resume the TLS session of the control connection,
+	// which many servers require.
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	// The certificate is checked against the name we were asked to dial,
+	// not against the resolved IP address.
+	if tlsConfig.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+	}
+	tconn := tls.Client(c.netConn, tlsConfig)
+	if err = tconn.Handshake(); err != nil {
+		return err
+	}
+	if err = c.checkFingerprint(tconn); err != nil {
+		tconn.Close()
+		return err
+	}
+	c.netConn = tconn
+	c.conn = textproto.NewConn(tconn)
+	c.tlsConfig = tlsConfig
+	return nil
+}
+
+// WithCertFingerprint pins the certificate of the server: the connection is
+// aborted after the TLS handshake unless the SHA-256 fingerprint of the
+// certificate presented by the server is fingerprint. This check is made in
+// addition to the usual verification of the certificate chain, which may be
+// disabled with the InsecureSkipVerify field of the TLS configuration.
+func WithCertFingerprint(fingerprint []byte) Option {
+	return func(c *Client) {
+		c.certFingerprint = fingerprint
+	}
+}
+
+// checkFingerprint verifies the certificate of the server against the pinned
+// fingerprint, if any.
+func (c *Client) checkFingerprint(tconn *tls.Conn) error {
+	if c.certFingerprint == nil {
+		return nil
+	}
+	certs := tconn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ErrCertFingerprint
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	if subtle.ConstantTimeCompare(sum[:], c.certFingerprint) != 1 {
+		return ErrCertFingerprint
+	}
+	return nil
+}
+
+// ConnectionState returns the state of the TLS session of the control
+// connection, such as the negotiated version and cipher suite, and false
+// when the control connection is not encrypted, including after
+// ClearCommandChannel.
+func (c *Client) ConnectionState() (tls.ConnectionState, bool) {
+	tconn, ok := c.netConn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tconn.ConnectionState(), true
+}
+
+// SetDataProtection issues a PROT FTP command to change the protection level
+// of the following data connections, ProtPrivate encrypting them with TLS and
+// ProtClear sending them in clear. The control connection stays encrypted.
+func (c *Client) SetDataProtection(level ProtLevel) error {
+	if c.tlsConfig == nil {
+		return errors.New("Data protection requires a TLS control connection")
+	}
+	if level != ProtClear && level != ProtPrivate {
+		return errors.New("Unsupported data protection level " + string(level))
+	}
+	// PBSZ must be issued once before the first PROT command
+	if c.protLevel == "" {
+		if err := c.pbsz(); err != nil {
+			return err
+		}
+	}
+	return c.prot(level)
+}
+
+// protectData protects the data connections of a TLS session, unless the
+// protection level was already set or the server does not advertise the
+// PBSZ and PROT commands.
+func (c *Client) protectData() error {
+	if c.tlsConfig == nil || c.protLevel != "" {
+		return nil
+	}
+	_, pbsz := c.features["PBSZ"]
+	_, prot := c.features["PROT"]
+	if !pbsz || !prot {
+		return nil
+	}
+	return c.SetDataProtection(ProtPrivate)
+}
+
+// pbsz issues a "PBSZ 0" command, TLS being a stream protection mechanism.
+func (c *Client) pbsz() error {
+	_, _, err := c.cmd(StatusCommandOK, "PBSZ 0")
+	return err
+}
+
+// prot issues a PROT command and remembers the negotiated level.
+func (c *Client) prot(level ProtLevel) error {
+	_, _, err := c.cmd(StatusCommandOK, "PROT %s", level)
+	if err != nil {
+		return err
+	}
+	c.protLevel = level
+	return nil
+}
+
+// ClearCommandChannel issues a CCC FTP command, which reverts the control
+// connection to clear text after the authentication, while the data
+// connections keep the protection set with SetDataProtection. The firewalls
+// which rewrite the PASV replies, being unable to read the encrypted control
+// connection, otherwise break the data connections of FTPS behind a NAT.
+//
+// ErrUnsupported is returned when the server does not advertise CCC.
+func (c *Client) ClearCommandChannel() error {
+	tconn, ok := c.netConn.(*tls.Conn)
+	if !ok {
+		return errors.New("The control connection is not encrypted")
+	}
+	if _, ok := c.features["CCC"]; !ok {
+		return ErrUnsupported
+	}
+	if _, _, err := c.cmd(StatusCommandOK, "CCC"); err != nil {
+		return unsupported(err)
+	}
+	// both sides end the TLS session with a close_notify alert
+	if err := tconn.CloseWrite(); err != nil {
+		return err
+	}
+	if c.timeout > 0 {
+		tconn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer tconn.SetReadDeadline(time.Time{})
+	}
+	if _, err := io.Copy(ioutil.Discard, tconn); err != nil {
+		return err
+	}
+	// closing the TLS session also closed the connection for writing
+	c.netConn = tconn.NetConn()
+	c.netConn.SetWriteDeadline(time.Time{})
+	c.conn = textproto.NewConn(c.netConn)
+	c.clearCommand = true
+	return nil
+}
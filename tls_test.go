@@ -0,0 +1,265 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestDialTLS(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+
+	c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.netConn.(*tls.Conn); !ok {
+		t.Error("the control connection is not encrypted")
+	}
+	// the features are discovered over the encrypted connection
+	commands := mock.Commands()
+	if len(commands) < 2 || commands[0] != "AUTH TLS" || commands[1] != "FEAT" {
+		t.Errorf("got commands %v, expected AUTH TLS then FEAT", commands)
+	}
+	if _, ok := c.features["PBSZ"]; !ok {
+		t.Errorf("PBSZ missing from the features %v", c.features)
+	}
+	if err = c.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDataProtectionToggle(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+
+	c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.SetDataProtection(ProtPrivate); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Stor("secret", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.SetDataProtection(ProtClear); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Retr("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Error(err)
+	}
+	if string(buf) != testData {
+		t.Errorf("read %q, expected %q", buf, testData)
+	}
+
+	dataTLS := mock.DataTLS()
+	if len(dataTLS) != 2 || !dataTLS[0] || dataTLS[1] {
+		t.Errorf("data connections encryption = %v, expected [true false]", dataTLS)
+	}
+
+	pbsz := 0
+	for _, cmd := range mock.Commands() {
+		if cmd == "PBSZ 0" {
+			pbsz++
+		}
+	}
+	if pbsz != 1 {
+		t.Errorf("PBSZ sent %d times, expected once", pbsz)
+	}
+}
+
+func TestLoginProtectsData(t *testing.T) {
+	for _, advertised := range []bool{true, false} {
+		mock, tlsConfig := newFtpMockTLS(t)
+		if !advertised {
+			mock.features = []string{"EPSV", "UTF8", "AUTH TLS"}
+		}
+		c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Login("anonymous", "anonymous"); err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Stor("secret", bytes.NewBufferString(testData)); err != nil {
+			t.Fatal(err)
+		}
+		if dataTLS := mock.DataTLS(); len(dataTLS) != 1 || dataTLS[0] != advertised {
+			t.Errorf("with PBSZ and PROT advertised %v, data connections encryption = %v", advertised, dataTLS)
+		}
+		c.Close()
+		mock.Close()
+	}
+}
+
+func TestClearCommandChannel(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+
+	c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.ClearCommandChannel(); err != ErrUnsupported {
+		t.Errorf("got error %v, expected ErrUnsupported without the CCC feature", err)
+	}
+	mock.features = append(mock.features, "CCC")
+	c.features["CCC"] = ""
+
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetDataProtection(ProtPrivate); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.ClearCommandChannel(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.netConn.(*tls.Conn); ok {
+		t.Error("the control connection is still encrypted")
+	}
+
+	// the data connections stay encrypted
+	if err = c.Stor("secret", bytes.NewBufferString(testData)); err != nil {
+		t.Fatal(err)
+	}
+	if dataTLS := mock.DataTLS(); len(dataTLS) != 1 || !dataTLS[0] {
+		t.Errorf("data connections encryption = %v, expected [true]", dataTLS)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectionState(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.ConnectionState(); ok {
+		t.Error("got a TLS state for a connection in clear")
+	}
+	c.Close()
+
+	c, err = DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	state, ok := c.ConnectionState()
+	if !ok {
+		t.Fatal("got no TLS state for an encrypted connection")
+	}
+	if !state.HandshakeComplete || state.Version < tls.VersionTLS12 || state.CipherSuite == 0 {
+		t.Errorf("unexpected TLS state: version %#x, cipher suite %#x", state.Version, state.CipherSuite)
+	}
+}
+
+func TestDataProtectionWithoutTLS(t *testing.T) {
+	mock := newFtpMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetDataProtection(ProtPrivate); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func TestDataTLSHandshakeFailure(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+	mock.Handle("RETR", func(s *mockSession, arg string) {
+		s.Reply(StatusAboutToSend, "Opening data connection")
+		conn, err := s.dataLn.Accept()
+		s.dataLn.Close()
+		s.dataLn = nil
+		if err == nil {
+			conn.Write([]byte("not a TLS record\r\n"))
+			conn.Close()
+		}
+		s.Reply(StatusCanNotOpenDataConnection, "SSL connection failed; session reuse required")
+	})
+
+	c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.SetDataProtection(ProtPrivate); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Retr("file")
+	if !errors.Is(err, ErrDataTLSHandshake) {
+		t.Fatalf("got error %v, expected ErrDataTLSHandshake", err)
+	}
+	if err = c.NoOp(); err != nil {
+		t.Errorf("control connection out of sync: %v", err)
+	}
+}
+
+func TestCertFingerprint(t *testing.T) {
+	mock, tlsConfig := newFtpMockTLS(t)
+	defer mock.Close()
+	fingerprint := sha256.Sum256(mock.tlsConfig.Certificates[0].Certificate[0])
+
+	c, err := DialTLS(mock.Addr(), tlsConfig, 5*time.Second, WithCertFingerprint(fingerprint[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Login("anonymous", "anonymous"); err != nil {
+		t.Error(err)
+	}
+	c.Close()
+
+	fingerprint[0] ^= 0xff
+	_, err = DialTLS(mock.Addr(), tlsConfig, 5*time.Second, WithCertFingerprint(fingerprint[:]))
+	if err != ErrCertFingerprint {
+		t.Errorf("got error %v, expected ErrCertFingerprint", err)
+	}
+}
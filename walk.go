@@ -0,0 +1,126 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// WalkDirs walks the tree of directories below root, depth first, calling fn
+// for each directory with its path joined to root. Only the directories are
+// listed, the files are never enumerated, nor are the links followed.
+//
+// When fn returns filepath.SkipDir, the directory is not descended into. Any
+// other error stops the walk, and is returned by WalkDirs.
+func (c *Client) WalkDirs(root string, fn func(path string, entry *Entry) error) error {
+	dirs, err := c.ListDirs(root)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		p := path.Join(root, dir.Name)
+		if err = fn(p, dir); err == filepath.SkipDir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = c.WalkDirs(p, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk walks the tree rooted at root, depth first and in lexical order,
+// calling fn for root first, like filepath.Walk, then for each entry below
+// it with its path joined to root. The directories are listed with List,
+// without changing the current directory, and the links are not followed.
+//
+// The entry of root comes from a MLST FTP command when the server supports
+// it, and the tree is only walked when root is a directory. Otherwise root is
+// taken for a directory, as LIST can not describe it without listing its
+// parent, and the entry only holds its name and type.
+//
+// When root can not be described or a directory can not be listed, fn is
+// called with its path, a nil entry and the error. When fn returns
+// filepath.SkipDir for a directory, it is not descended into, and for a
+// file, the remaining entries of its directory are skipped. Any other error
+// stops the walk, and is returned by Walk.
+func (c *Client) Walk(root string, fn func(path string, entry *Entry, err error) error) error {
+	entry, err := c.rootEntry(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else if err = fn(root, entry, nil); err == nil && entry.Type == EntryTypeFolder {
+		err = c.walk(root, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// rootEntry returns the entry of the root of Walk.
+func (c *Client) rootEntry(root string) (*Entry, error) {
+	entry := &Entry{Name: path.Base(root), Type: EntryTypeFolder}
+	if !c.mlst {
+		return entry, nil
+	}
+	line, err := c.mlstLine(root)
+	if err != nil {
+		return nil, err
+	}
+	if entry, err = parseRFC3659ListLine(line); err != nil {
+		return nil, err
+	}
+	entry.Name = path.Base(root)
+	if entry.Type == EntryTypeCurrent || entry.Type == EntryTypeParent {
+		entry.Type = EntryTypeFolder
+	}
+	return entry, nil
+}
+
+// walk walks the tree below dir for Walk.
+func (c *Client) walk(dir string, fn func(path string, entry *Entry, err error) error) error {
+	entries, err := c.List(dir)
+	if err != nil {
+		return fn(dir, nil, err)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	for _, entry := range entries {
+		if entry.Type == EntryTypeCurrent || entry.Type == EntryTypeParent || entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		p := path.Join(dir, entry.Name)
+		if err = fn(p, entry, nil); err == filepath.SkipDir {
+			if entry.Type == EntryTypeFolder {
+				continue
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if entry.Type != EntryTypeFolder {
+			continue
+		}
+		if err = c.walk(p, fn); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+//Copyright (c) 2011-2017, Julien Laffaye <jlaffaye@FreeBSD.org> and hwfy
+
+//Permission to use, copy, modify, and/or distribute this software for any
+//purpose with or without fee is hereby granted, provided that the above
+//copyright notice and this permission notice appear in all copies.
+
+//THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+//WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+//MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+//ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+//WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+//ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+//OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package ftp
+
+import (
+	"errors"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWalkMock returns a mock server holding the tree:
+//
+//	/root/a/a1
+//	/root/a/a2/deep
+//	/root/b
+//	/root/file.txt
+func newWalkMock(t *testing.T) *ftpMock {
+	mock := newFtpMock(t)
+	mock.SetListing("/root",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 .",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 ..",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 a",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 b",
+		"-rw-r--r--    1 110      1002          951 Dec 02  2009 file.txt",
+	)
+	mock.SetListing("/root/a",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 a1",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 a2",
+	)
+	mock.SetListing("/root/a/a2",
+		"drwxr-xr-x    3 110      1002            3 Dec 02  2009 deep",
+	)
+	return mock
+}
+
+func TestWalkDirs(t *testing.T) {
+	mock := newWalkMock(t)
+	defer mock.Close()
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var paths []string
+	err = c.WalkDirs("/root", func(path string, entry *Entry) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/root/a", "/root/a/a1", "/root/a/a2", "/root/a/a2/deep", "/root/b"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("walked %v, expected %v", paths, expected)
+	}
+
+	paths = nil
+	err = c.WalkDirs("/root", func(path string, entry *Entry) error {
+		paths = append(paths, path)
+		if entry.Name == "a" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"/root/a", "/root/b"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("walked %v, expected %v", paths, expected)
+	}
+	listed := 0
+	for _, cmd := range mock.Commands() {
+		if cmd == "LIST /root/a" {
+			listed++
+		}
+	}
+	if listed != 1 {
+		t.Errorf("skipped directory listed %d times by the two walks, expected once", listed)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	mock := newWalkMock(t)
+	defer mock.Close()
+	mock.Handle("LIST", func(s *mockSession, arg string) {
+		if arg == "/root/b" {
+			s.Reply(StatusFileUnavailable, "Permission denied")
+			return
+		}
+		s.handle("LIST", arg)
+	})
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var paths []string
+	var listErr error
+	err = c.Walk("/root", func(path string, entry *Entry, err error) error {
+		if err != nil {
+			listErr = err
+			paths = append(paths, path+" (error)")
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/root", "/root/a", "/root/a/a1", "/root/a/a2", "/root/a/a2/deep", "/root/b", "/root/b (error)", "/root/file.txt"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("walked %v, expected %v", paths, expected)
+	}
+	if listErr == nil {
+		t.Error("expected the listing error of /root/b")
+	}
+
+	paths = nil
+	err = c.Walk("/root", func(path string, entry *Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		if entry.Name == "a" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != StatusFileUnavailable {
+		t.Errorf("got error %v, expected the listing error of /root/b", err)
+	}
+	expected = []string{"/root", "/root/a", "/root/b"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("walked %v, expected %v", paths, expected)
+	}
+
+	// skipping root walks nothing else
+	paths = nil
+	sent := len(mock.Commands())
+	err = c.Walk("/root", func(path string, entry *Entry, err error) error {
+		paths = append(paths, path)
+		return filepath.SkipDir
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/root" {
+		t.Errorf("walked %v, expected only /root", paths)
+	}
+	if commands := mock.Commands(); len(commands) != sent {
+		t.Errorf("got commands %v after skipping root", commands[sent:])
+	}
+
+	errStop := errors.New("stop")
+	err = c.Walk("/root", func(path string, entry *Entry, err error) error {
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("got error %v, expected the error of fn", err)
+	}
+	for _, cmd := range mock.Commands() {
+		if strings.HasPrefix(cmd, "CWD") || cmd == "CDUP" {
+			t.Errorf("unexpected %s changing the current directory", cmd)
+		}
+	}
+}
+
+func TestWalkFile(t *testing.T) {
+	mock := newWalkMock(t)
+	defer mock.Close()
+	mock.features = append(mock.features, "MLST type*;size*;modify*;")
+	mock.SetFile("/root/file.txt", []byte(testData))
+
+	c, err := DialTimeout(mock.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var entries []*Entry
+	err = c.Walk("/root/file.txt", func(path string, entry *Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "file.txt" || entries[0].Type != EntryTypeFile || entries[0].Size != uint64(len(testData)) {
+		t.Errorf("walked %v, expected only the file", entries)
+	}
+	for _, cmd := range mock.Commands() {
+		if strings.HasPrefix(cmd, "LIST") || strings.HasPrefix(cmd, "MLSD") {
+			t.Errorf("unexpected %s walking a file", cmd)
+		}
+	}
+}